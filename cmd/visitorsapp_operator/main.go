@@ -18,10 +18,12 @@ package main
 
 import (
 	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	"example.com/m/v2/pkg/controllers"
 	"example.com/m/v2/pkg/workload_ensurers"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -37,21 +39,27 @@ import (
 )
 
 const (
-	mysqlDeploymentName = "mysql"
-	mysqlServiceName    = "mysql-service"
-	mysqlAuthName       = "mysql-auth"
+	mysqlDeploymentPostfix  = "-mysql"
+	mysqlServicePostfix     = "-mysql-service"
+	mysqlAuthPostfix        = "-mysql-auth"
+	mysqlMigrationPostfix   = "-mysql-migration"
+	mysqlBackupPostfix      = "-mysql-backup"
+	mysqlRestorePostfix     = "-mysql-restore"
+	mysqlSnapshotPostfix    = "-mysql-snapshot"
+	mysqlRotationPostfix    = "-mysql-password-rotation"
+	mysqlPendingAuthPostfix = "-mysql-auth-pending"
+	mysqlRootJobPostfix     = "-mysql-root-password"
+	mysqlAppliedRootPostfix = "-mysql-root-applied"
 
 	backendPort              = 8000
-	backendServicePort       = 30685
-	backendImage             = "jdob/visitors-service:1.0.0"
 	backendDeploymentPostfix = "-backend"
 	backendServicePostfix    = "-backend-service"
 
 	frontendPort              = 3000
-	frontendServicePort       = 30686
-	frontendImage             = "jdob/visitors-webui:1.0.0"
 	frontendDeploymentPostfix = "-frontend"
 	frontendServicePostfix    = "-frontend-service"
+
+	ingressPostfix = "-ingress"
 )
 
 var (
@@ -63,6 +71,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(appv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(appv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -70,11 +79,18 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var reconcileTimeout time.Duration
+	var maxConcurrentReconciles int
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 2*time.Minute,
+		"The deadline of a single reconcile, API calls still in flight past it are cancelled. "+
+			"Zero disables the deadline.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of VisitorsApps that can be reconciled in parallel.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -96,44 +112,168 @@ func main() {
 		os.Exit(1)
 	}
 
+	recorder := mgr.GetEventRecorderFor("visitorsapp-controller")
 	ensureWorkloadDirector := workload_ensurers.NewEnsureWorkloadDirector()
 	mysqlEnsurer := workload_ensurers.NewMysqlEnsurer(
 		mgr.GetClient(),
-		mysqlDeploymentName,
-		mysqlServiceName,
-		mysqlAuthName,
+		recorder,
+		mysqlDeploymentPostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+		mysqlMigrationPostfix,
+		appv1beta1.DefaultMySQLImage,
 	)
+	externalDbEnsurer := workload_ensurers.NewExternalDatabaseEnsurer(mgr.GetClient(), recorder)
 	backendEnsurer := workload_ensurers.NewBackendEnsurer(
 		mgr.GetClient(),
+		recorder,
 		backendPort,
-		backendServicePort,
-		backendImage,
-		mysqlAuthName,
-		mysqlServiceName,
+		appv1beta1.DefaultBackendImage,
+		mysqlAuthPostfix,
+		mysqlServicePostfix,
 		backendDeploymentPostfix,
 		backendServicePostfix,
 	)
 	frontendEnsurer := workload_ensurers.NewFrontendEnsurer(
 		mgr.GetClient(),
+		recorder,
 		frontendPort,
-		frontendServicePort,
-		frontendImage,
+		appv1beta1.DefaultFrontendImage,
 		frontendDeploymentPostfix,
 		frontendServicePostfix,
 	)
 
+	restoreEnsurer := workload_ensurers.NewRestoreEnsurer(
+		mgr.GetClient(),
+		recorder,
+		appv1beta1.DefaultMySQLImage,
+		mysqlRestorePostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+	)
+	backupEnsurer := workload_ensurers.NewBackupEnsurer(
+		mgr.GetClient(),
+		mgr.GetAPIReader(),
+		recorder,
+		appv1beta1.DefaultMySQLImage,
+		mysqlBackupPostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+	)
+	rotationEnsurer := workload_ensurers.NewRotationEnsurer(
+		mgr.GetClient(),
+		recorder,
+		appv1beta1.DefaultMySQLImage,
+		mysqlRotationPostfix,
+		mysqlPendingAuthPostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+	)
+	ingressEnsurer := workload_ensurers.NewIngressEnsurer(
+		mgr.GetClient(),
+		recorder,
+		backendPort,
+		frontendPort,
+		backendServicePostfix,
+		frontendServicePostfix,
+		ingressPostfix,
+	)
+	cleanupEnsurer := workload_ensurers.NewCleanupEnsurer(
+		mgr.GetClient(),
+		recorder,
+		appv1beta1.DefaultMySQLImage,
+		mysqlSnapshotPostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+	)
+	rootPasswordEnsurer := workload_ensurers.NewRootPasswordEnsurer(
+		mgr.GetClient(),
+		recorder,
+		appv1beta1.DefaultMySQLImage,
+		mysqlRootJobPostfix,
+		mysqlAppliedRootPostfix,
+		mysqlServicePostfix,
+		mysqlAuthPostfix,
+	)
+
+	// Tiers are ensured once the ones they depend on are ready, new tiers
+	// only need to be declared here
+	tierPipeline, err := workload_ensurers.NewTierPipeline(
+		ensureWorkloadDirector,
+		workload_ensurers.TierDefinition{
+			Name:           "mysql",
+			ReadyCondition: appv1beta1.ConditionMySQLReady,
+			Ensurer:        workload_ensurers.NewDatabaseEnsurer(mysqlEnsurer, externalDbEnsurer),
+		},
+		workload_ensurers.TierDefinition{
+			Name:      "restore",
+			DependsOn: []string{"mysql"},
+			Ensurer:   restoreEnsurer,
+		},
+		workload_ensurers.TierDefinition{
+			Name:      "backup",
+			DependsOn: []string{"mysql"},
+			Ensurer:   backupEnsurer,
+		},
+		workload_ensurers.TierDefinition{
+			Name:      "root-password",
+			DependsOn: []string{"mysql"},
+			Ensurer:   rootPasswordEnsurer,
+		},
+		workload_ensurers.TierDefinition{
+			Name:      "rotation",
+			DependsOn: []string{"mysql", "restore"},
+			Ensurer:   rotationEnsurer,
+		},
+		workload_ensurers.TierDefinition{
+			Name:           "backend",
+			DependsOn:      []string{"mysql", "restore"},
+			ReadyCondition: appv1beta1.ConditionBackendAvailable,
+			Ensurer:        backendEnsurer,
+		},
+		// The frontend only needs the name of the backend Service, so it
+		// rolls out alongside the backend rather than after it
+		workload_ensurers.TierDefinition{
+			Name:           "frontend",
+			ReadyCondition: appv1beta1.ConditionFrontendAvailable,
+			Ensurer:        frontendEnsurer,
+		},
+		workload_ensurers.TierDefinition{
+			Name:    "ingress",
+			Ensurer: ingressEnsurer,
+		},
+	)
+	if err != nil {
+		setupLog.Error(err, "unable to declare the tiers")
+		os.Exit(1)
+	}
+
 	visitorsAppController := controllers.NewVisitorsAppController(
 		mgr.GetClient(),
 		mgr.GetScheme(),
+		recorder,
+		reconcileTimeout,
+		maxConcurrentReconciles,
 		ensureWorkloadDirector,
-		mysqlEnsurer,
-		backendEnsurer,
-		frontendEnsurer,
+		tierPipeline,
+		cleanupEnsurer,
 	)
 	if err = visitorsAppController.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VisitorsApp")
 		os.Exit(1)
 	}
+	// Webhooks need serving certificates, set ENABLE_WEBHOOKS=false to run
+	// the operator locally without them
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&appv1alpha1.VisitorsApp{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "VisitorsApp")
+			os.Exit(1)
+		}
+		if err = (&appv1beta1.VisitorsApp{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "VisitorsApp")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
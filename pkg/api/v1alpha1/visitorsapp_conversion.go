@@ -0,0 +1,282 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"example.com/m/v2/pkg/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// conversionDataAnnotation holds the v1beta1 fields v1alpha1 has no place for,
+// so that converting through v1alpha1 and back doesn't lose them
+const conversionDataAnnotation = "app.my.domain/conversion-data"
+
+// ConvertTo converts this VisitorsApp to the hub version. The v1alpha1 spec
+// maps field for field onto v1beta1: spec.title moves to spec.frontend.title
+// and spec.mysql to spec.database.mysql.
+func (src *VisitorsApp) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.VisitorsApp)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 VisitorsApp but got a %T", dstRaw)
+	}
+
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+	restored, err := unmarshalConversionData(&dst.ObjectMeta)
+	if err != nil {
+		return err
+	}
+
+	dst.Spec.Size = src.Spec.Size
+	dst.Spec.Database.MySQL = v1beta1.MySQLSpec{
+		TierSpec:          convertTierTo(src.Spec.MySQL.TierSpec),
+		CredentialsSecret: src.Spec.MySQL.CredentialsSecret,
+	}
+	if restore := src.Spec.MySQL.RestoreFrom; restore != nil {
+		dst.Spec.Database.MySQL.RestoreFrom = &v1beta1.RestoreSource{
+			ClaimName: restore.ClaimName,
+			File:      restore.File,
+		}
+	}
+	if storage := src.Spec.MySQL.Storage; storage != nil {
+		dst.Spec.Database.MySQL.Storage = &v1beta1.MySQLStorageSpec{
+			StorageClassName: storage.StorageClassName,
+			Size:             storage.Size,
+		}
+	}
+	if external := src.Spec.Database.External; external != nil {
+		dst.Spec.Database.External = &v1beta1.ExternalDatabaseSpec{
+			Host:              external.Host,
+			Port:              external.Port,
+			DatabaseName:      external.DatabaseName,
+			CredentialsSecret: external.CredentialsSecret,
+		}
+	}
+	dst.Spec.Backend.TierSpec = convertTierTo(src.Spec.Backend.TierSpec)
+	dst.Spec.Frontend.TierSpec = convertTierTo(src.Spec.Frontend.TierSpec)
+	dst.Spec.Frontend.Title = src.Spec.Title
+	if backup := src.Spec.Backup; backup != nil {
+		dst.Spec.Backup = &v1beta1.BackupSpec{
+			Schedule:  backup.Schedule,
+			Retention: backup.Retention,
+			TargetPVC: backup.TargetPVC,
+		}
+	}
+
+	dst.Status = v1beta1.VisitorsAppStatus{
+		BackendImage:       src.Status.BackendImage,
+		FrontendImage:      src.Status.FrontendImage,
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Conditions:         copyConditions(src.Status.Conditions),
+	}
+	if lastBackup := src.Status.LastBackup; lastBackup != nil {
+		dst.Status.LastBackup = &v1beta1.BackupStatus{
+			CompletionTime: lastBackup.CompletionTime,
+			Size:           lastBackup.Size,
+			File:           lastBackup.File,
+		}
+	}
+
+	if restored != nil {
+		dst.Spec.DeletionPolicy = restored.DeletionPolicy
+		dst.Spec.Database.MySQL.PasswordRotation = restored.PasswordRotation
+		if restored.BackendService != nil {
+			dst.Spec.Backend.Service = *restored.BackendService
+		}
+		if restored.FrontendService != nil {
+			dst.Spec.Frontend.Service = *restored.FrontendService
+		}
+		dst.Spec.Ingress = restored.Ingress
+		dst.Status.Replicas = restored.Replicas
+		dst.Status.Selector = restored.Selector
+		dst.Status.LastPasswordRotation = restored.LastPasswordRotation
+		dst.Status.URL = restored.URL
+	}
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this version
+func (dst *VisitorsApp) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.VisitorsApp)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 VisitorsApp but got a %T", srcRaw)
+	}
+
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+	if err := marshalConversionData(src, &dst.ObjectMeta); err != nil {
+		return err
+	}
+
+	dst.Spec.Size = src.Spec.Size
+	dst.Spec.Title = src.Spec.Frontend.Title
+	dst.Spec.MySQL = MySQLSpec{
+		TierSpec:          convertTierFrom(src.Spec.Database.MySQL.TierSpec),
+		CredentialsSecret: src.Spec.Database.MySQL.CredentialsSecret,
+	}
+	if restore := src.Spec.Database.MySQL.RestoreFrom; restore != nil {
+		dst.Spec.MySQL.RestoreFrom = &RestoreSource{
+			ClaimName: restore.ClaimName,
+			File:      restore.File,
+		}
+	}
+	if storage := src.Spec.Database.MySQL.Storage; storage != nil {
+		dst.Spec.MySQL.Storage = &MySQLStorageSpec{
+			StorageClassName: storage.StorageClassName,
+			Size:             storage.Size,
+		}
+	}
+	if external := src.Spec.Database.External; external != nil {
+		dst.Spec.Database.External = &ExternalDatabaseSpec{
+			Host:              external.Host,
+			Port:              external.Port,
+			DatabaseName:      external.DatabaseName,
+			CredentialsSecret: external.CredentialsSecret,
+		}
+	}
+	dst.Spec.Backend.TierSpec = convertTierFrom(src.Spec.Backend.TierSpec)
+	dst.Spec.Frontend.TierSpec = convertTierFrom(src.Spec.Frontend.TierSpec)
+	if backup := src.Spec.Backup; backup != nil {
+		dst.Spec.Backup = &BackupSpec{
+			Schedule:  backup.Schedule,
+			Retention: backup.Retention,
+			TargetPVC: backup.TargetPVC,
+		}
+	}
+
+	dst.Status = VisitorsAppStatus{
+		BackendImage:       src.Status.BackendImage,
+		FrontendImage:      src.Status.FrontendImage,
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Conditions:         copyConditions(src.Status.Conditions),
+	}
+	if lastBackup := src.Status.LastBackup; lastBackup != nil {
+		dst.Status.LastBackup = &BackupStatus{
+			CompletionTime: lastBackup.CompletionTime,
+			Size:           lastBackup.Size,
+			File:           lastBackup.File,
+		}
+	}
+	return nil
+}
+
+// conversionData holds the v1beta1 fields v1alpha1 has no place for
+// +kubebuilder:object:generate=false
+type conversionData struct {
+	DeletionPolicy       v1beta1.DeletionPolicy        `json:"deletionPolicy,omitempty"`
+	PasswordRotation     *v1beta1.PasswordRotationSpec `json:"passwordRotation,omitempty"`
+	BackendService       *v1beta1.ServiceSpec          `json:"backendService,omitempty"`
+	FrontendService      *v1beta1.ServiceSpec          `json:"frontendService,omitempty"`
+	Ingress              *v1beta1.IngressSpec          `json:"ingress,omitempty"`
+	Replicas             int32                         `json:"replicas,omitempty"`
+	Selector             string                        `json:"selector,omitempty"`
+	LastPasswordRotation *metav1.Time                  `json:"lastPasswordRotation,omitempty"`
+	URL                  string                        `json:"url,omitempty"`
+}
+
+// marshalConversionData records the hub only fields in the annotations of the
+// converted object, unless they are all unset
+func marshalConversionData(src *v1beta1.VisitorsApp, dst *metav1.ObjectMeta) error {
+	hubOnly := conversionData{
+		DeletionPolicy:       src.Spec.DeletionPolicy,
+		PasswordRotation:     src.Spec.Database.MySQL.PasswordRotation,
+		Ingress:              src.Spec.Ingress,
+		Replicas:             src.Status.Replicas,
+		Selector:             src.Status.Selector,
+		LastPasswordRotation: src.Status.LastPasswordRotation,
+		URL:                  src.Status.URL,
+	}
+	if !equality.Semantic.DeepEqual(src.Spec.Backend.Service, v1beta1.ServiceSpec{}) {
+		hubOnly.BackendService = &src.Spec.Backend.Service
+	}
+	if !equality.Semantic.DeepEqual(src.Spec.Frontend.Service, v1beta1.ServiceSpec{}) {
+		hubOnly.FrontendService = &src.Spec.Frontend.Service
+	}
+	if equality.Semantic.DeepEqual(hubOnly, conversionData{}) {
+		return nil
+	}
+	data, err := json.Marshal(hubOnly)
+	if err != nil {
+		return fmt.Errorf("marshaling conversion data: %w", err)
+	}
+
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[conversionDataAnnotation] = string(data)
+	return nil
+}
+
+// unmarshalConversionData removes the hub only fields recorded by
+// marshalConversionData from the annotations and returns them, or nil when
+// there are none
+func unmarshalConversionData(dst *metav1.ObjectMeta) (*conversionData, error) {
+	data, ok := dst.Annotations[conversionDataAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	delete(dst.Annotations, conversionDataAnnotation)
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	hubOnly := &conversionData{}
+	if err := json.Unmarshal([]byte(data), hubOnly); err != nil {
+		return nil, fmt.Errorf("unmarshaling conversion data: %w", err)
+	}
+	return hubOnly, nil
+}
+
+// copyConditions copies the conditions so that the converted object doesn't
+// share them with its source
+func copyConditions(src []metav1.Condition) []metav1.Condition {
+	if src == nil {
+		return nil
+	}
+	dst := make([]metav1.Condition, len(src))
+	for i := range src {
+		src[i].DeepCopyInto(&dst[i])
+	}
+	return dst
+}
+
+func convertTierTo(src TierSpec) v1beta1.TierSpec {
+	return v1beta1.TierSpec{
+		Image:        src.Image,
+		Replicas:     src.Replicas,
+		Resources:    src.Resources,
+		Env:          src.Env,
+		NodeSelector: src.NodeSelector,
+		Tolerations:  src.Tolerations,
+		Affinity:     src.Affinity,
+	}
+}
+
+func convertTierFrom(src v1beta1.TierSpec) TierSpec {
+	return TierSpec{
+		Image:        src.Image,
+		Replicas:     src.Replicas,
+		Resources:    src.Resources,
+		Env:          src.Env,
+		NodeSelector: src.NodeSelector,
+		Tolerations:  src.Tolerations,
+		Affinity:     src.Affinity,
+	}
+}
@@ -0,0 +1,233 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"example.com/m/v2/pkg/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestHub returns a v1beta1 app with every field v1alpha1 has a place for
+func newTestHub() *v1beta1.VisitorsApp {
+	storageClass := "standard"
+	replicas := int32(2)
+	tier := v1beta1.TierSpec{
+		Image:        "example/image:1",
+		Replicas:     &replicas,
+		Env:          []corev1.EnvVar{{Name: "KEY", Value: "value"}},
+		NodeSelector: map[string]string{"disk": "ssd"},
+	}
+	return &v1beta1.VisitorsApp{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{"team": "visitors"},
+		},
+		Spec: v1beta1.VisitorsAppSpec{
+			Size: 3,
+			Database: v1beta1.DatabaseSpec{
+				MySQL: v1beta1.MySQLSpec{
+					TierSpec:          tier,
+					CredentialsSecret: "credentials",
+					RestoreFrom:       &v1beta1.RestoreSource{ClaimName: "dumps", File: "dump.sql"},
+					Storage: &v1beta1.MySQLStorageSpec{
+						StorageClassName: &storageClass,
+						Size:             resource.MustParse("1Gi"),
+					},
+				},
+			},
+			Backend:  v1beta1.BackendSpec{TierSpec: tier},
+			Frontend: v1beta1.FrontendSpec{TierSpec: tier, Title: "Visitors"},
+			Backup:   &v1beta1.BackupSpec{Schedule: "@daily", Retention: 7, TargetPVC: "backups"},
+		},
+		Status: v1beta1.VisitorsAppStatus{
+			BackendImage:  "backend:1",
+			FrontendImage: "frontend:1",
+			LastBackup: &v1beta1.BackupStatus{
+				CompletionTime: metav1.NewTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+				Size:           resource.MustParse("10Mi"),
+				File:           "app-20220101000000.sql",
+			},
+			ObservedGeneration: 4,
+			Conditions: []metav1.Condition{{
+				Type:               v1beta1.ConditionMySQLReady,
+				Status:             metav1.ConditionTrue,
+				Reason:             "Ready",
+				LastTransitionTime: metav1.NewTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+			}},
+		},
+	}
+}
+
+// Every v1beta1 field survives a conversion through v1alpha1, the ones
+// v1alpha1 has no place for through the conversion data annotation, which
+// holds them and nothing else
+func TestConvertHubRoundTrip(t *testing.T) {
+	lastRotation := metav1.NewTime(time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name string
+		// hubOnly sets a field v1alpha1 has no place for
+		hubOnly func(*v1beta1.VisitorsApp)
+		// key is the one expected in the conversion data, none when empty
+		key string
+	}{
+		{
+			name:    "no hub only field",
+			hubOnly: func(v *v1beta1.VisitorsApp) {},
+		},
+		{
+			name: "deletionPolicy",
+			hubOnly: func(v *v1beta1.VisitorsApp) {
+				v.Spec.DeletionPolicy = v1beta1.DeletionPolicySnapshot
+			},
+			key: "deletionPolicy",
+		},
+		{
+			name: "passwordRotation",
+			hubOnly: func(v *v1beta1.VisitorsApp) {
+				v.Spec.Database.MySQL.PasswordRotation = &v1beta1.PasswordRotationSpec{
+					Interval: metav1.Duration{Duration: 720 * time.Hour},
+				}
+			},
+			key: "passwordRotation",
+		},
+		{
+			name: "backend service",
+			hubOnly: func(v *v1beta1.VisitorsApp) {
+				v.Spec.Backend.Service = v1beta1.ServiceSpec{
+					Type:        corev1.ServiceTypeLoadBalancer,
+					Port:        8080,
+					Annotations: map[string]string{"lb": "internal"},
+				}
+			},
+			key: "backendService",
+		},
+		{
+			name: "frontend service",
+			hubOnly: func(v *v1beta1.VisitorsApp) {
+				v.Spec.Frontend.Service = v1beta1.ServiceSpec{Type: corev1.ServiceTypeClusterIP}
+			},
+			key: "frontendService",
+		},
+		{
+			name: "ingress",
+			hubOnly: func(v *v1beta1.VisitorsApp) {
+				v.Spec.Ingress = &v1beta1.IngressSpec{
+					Host:    "visitors.example.com",
+					Gateway: &v1beta1.GatewayReference{Name: "gateway"},
+				}
+			},
+			key: "ingress",
+		},
+		{
+			name:    "status.replicas",
+			hubOnly: func(v *v1beta1.VisitorsApp) { v.Status.Replicas = 3 },
+			key:     "replicas",
+		},
+		{
+			name:    "status.selector",
+			hubOnly: func(v *v1beta1.VisitorsApp) { v.Status.Selector = "app=visitors" },
+			key:     "selector",
+		},
+		{
+			name:    "status.url",
+			hubOnly: func(v *v1beta1.VisitorsApp) { v.Status.URL = "https://visitors.example.com/" },
+			key:     "url",
+		},
+		{
+			name:    "status.lastPasswordRotation",
+			hubOnly: func(v *v1beta1.VisitorsApp) { v.Status.LastPasswordRotation = &lastRotation },
+			key:     "lastPasswordRotation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newTestHub()
+			tt.hubOnly(hub)
+
+			spoke := &VisitorsApp{}
+			if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+				t.Fatalf("ConvertFrom: %v", err)
+			}
+
+			data, ok := spoke.Annotations[conversionDataAnnotation]
+			if tt.key == "" && ok {
+				t.Errorf("conversion data %s recorded without hub only fields", data)
+			}
+			if tt.key != "" {
+				fields := map[string]json.RawMessage{}
+				if err := json.Unmarshal([]byte(data), &fields); err != nil {
+					t.Fatalf("conversion data %q: %v", data, err)
+				}
+				if _, ok := fields[tt.key]; !ok || len(fields) != 1 {
+					t.Errorf("conversion data = %s, want only %q", data, tt.key)
+				}
+			}
+
+			converted := &v1beta1.VisitorsApp{}
+			if err := spoke.ConvertTo(converted); err != nil {
+				t.Fatalf("ConvertTo: %v", err)
+			}
+			if !equality.Semantic.DeepEqual(hub, converted) {
+				t.Errorf("round trip changed the app:\nwant %+v\ngot  %+v", hub, converted)
+			}
+		})
+	}
+}
+
+// Every v1alpha1 field survives a conversion through v1beta1, without
+// annotating the app
+func TestConvertSpokeRoundTrip(t *testing.T) {
+	hub := newTestHub()
+	spoke := &VisitorsApp{}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	spoke.Spec.Database.External = &ExternalDatabaseSpec{
+		Host:              "db.example.com",
+		Port:              3307,
+		DatabaseName:      "visitors",
+		CredentialsSecret: "external-credentials",
+	}
+
+	converted := &v1beta1.VisitorsApp{}
+	if err := spoke.DeepCopy().ConvertTo(converted); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	roundTripped := &VisitorsApp{}
+	if err := roundTripped.ConvertFrom(converted); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(spoke, roundTripped) {
+		t.Errorf("round trip changed the app:\nwant %+v\ngot  %+v", spoke, roundTripped)
+	}
+}
+
+// The converted app doesn't share its conditions with the source
+func TestConvertCopiesConditions(t *testing.T) {
+	hub := newTestHub()
+	spoke := &VisitorsApp{}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	spoke.Status.Conditions[0].Reason = "Changed"
+	if hub.Status.Conditions[0].Reason == "Changed" {
+		t.Error("ConvertFrom shares the conditions with the hub")
+	}
+
+	converted := &v1beta1.VisitorsApp{}
+	if err := spoke.ConvertTo(converted); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	converted.Status.Conditions[0].Reason = "ChangedAgain"
+	if spoke.Status.Conditions[0].Reason == "ChangedAgain" {
+		t.Error("ConvertTo shares the conditions with the spoke")
+	}
+}
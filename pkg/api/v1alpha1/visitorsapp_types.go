@@ -17,6 +17,8 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,6 +32,172 @@ type VisitorsAppSpec struct {
 
 	Size  int32  `json:"size"`
 	Title string `json:"title"`
+
+	// Database selects where the visitors database lives.
+	// +optional
+	Database DatabaseSpec `json:"database,omitempty"`
+
+	// MySQL configures the database tier.
+	// +optional
+	MySQL MySQLSpec `json:"mysql,omitempty"`
+
+	// Backend configures the visitors-service tier.
+	// +optional
+	Backend BackendSpec `json:"backend,omitempty"`
+
+	// Frontend configures the visitors-webui tier.
+	// +optional
+	Frontend FrontendSpec `json:"frontend,omitempty"`
+
+	// Backup schedules logical backups of the visitors database.
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+}
+
+// DatabaseSpec selects the database used by the backend
+type DatabaseSpec struct {
+	// External points the backend at an existing MySQL server instead of
+	// running one in the cluster. spec.mysql is ignored when set.
+	// +optional
+	External *ExternalDatabaseSpec `json:"external,omitempty"`
+}
+
+// ExternalDatabaseSpec describes a MySQL server managed outside of the operator
+type ExternalDatabaseSpec struct {
+	// Host name or address of the MySQL server.
+	Host string `json:"host"`
+
+	// Port of the MySQL server.
+	// +kubebuilder:default=3306
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// DatabaseName is the name of the visitors database on the server.
+	// +kubebuilder:default=visitors
+	// +optional
+	DatabaseName string `json:"databaseName,omitempty"`
+
+	// CredentialsSecret names a secret holding the database credentials
+	// under the username and password keys.
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// TierSpec holds the settings shared by every tier of the app.
+// Unset fields fall back to the operator defaults.
+type TierSpec struct {
+	// Image is the container image of the tier.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Replicas is the number of pods of the tier.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Resources are the compute resources of the tier container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Env lists extra environment variables for the tier container.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// NodeSelector constrains the tier pods to nodes with matching labels.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations of the tier pods.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Affinity scheduling rules of the tier pods.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+}
+
+// MySQLSpec configures the MySQL tier. Replicas default to 1, independently
+// of spec.size, and are capped at 1 since the pods don't replicate data
+// between each other.
+type MySQLSpec struct {
+	TierSpec `json:",inline"`
+
+	// CredentialsSecret names an existing secret holding the database
+	// credentials under the root-password, username and password keys.
+	// When empty, the operator generates a secret with random credentials.
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// RestoreFrom loads an existing dump into the database once MySQL is
+	// first ready, before the backend is deployed.
+	// +optional
+	RestoreFrom *RestoreSource `json:"restoreFrom,omitempty"`
+
+	// Storage enables persistent storage for the database. When set, MySQL
+	// runs as a StatefulSet with a volume claim template instead of a
+	// Deployment. An existing Deployment is replaced once its data has been
+	// copied to the volume.
+	// +optional
+	Storage *MySQLStorageSpec `json:"storage,omitempty"`
+}
+
+// RestoreSource points at a dump of the visitors database
+type RestoreSource struct {
+	// ClaimName of the persistent volume claim holding the dump.
+	ClaimName string `json:"claimName"`
+
+	// File is the path of the dump on the volume. Dumps ending in .gz are
+	// decompressed, which matches the files written by scheduled backups.
+	File string `json:"file"`
+}
+
+// MySQLStorageSpec configures the persistent volume of the MySQL tier
+type MySQLStorageSpec struct {
+	// StorageClassName of the data volume claim. The cluster default storage
+	// class is used when empty.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Size of the data volume. Growing it expands the existing claims when
+	// the storage class allows volume expansion.
+	Size resource.Quantity `json:"size"`
+}
+
+// BackendSpec configures the backend tier. Replicas default to spec.size.
+type BackendSpec struct {
+	TierSpec `json:",inline"`
+}
+
+// FrontendSpec configures the frontend tier. Replicas default to one.
+type FrontendSpec struct {
+	TierSpec `json:",inline"`
+}
+
+// BackupSpec configures the scheduled backups of the visitors database
+type BackupSpec struct {
+	// Schedule of the backups, in cron format.
+	Schedule string `json:"schedule"`
+
+	// Retention is the number of backups of the app kept on the target
+	// volume. The dumps are named after the app, so several apps can share
+	// the volume.
+	// +kubebuilder:default=7
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+
+	// TargetPVC names the persistent volume claim the dumps are written to.
+	TargetPVC string `json:"targetPVC"`
+}
+
+// BackupStatus describes a completed backup
+type BackupStatus struct {
+	// CompletionTime of the backup.
+	CompletionTime metav1.Time `json:"completionTime"`
+
+	// Size of the compressed dump.
+	Size resource.Quantity `json:"size"`
+
+	// File is the name of the dump on the target volume.
+	File string `json:"file"`
 }
 
 // VisitorsAppStatus defines the observed state of VisitorsApp
@@ -38,6 +206,20 @@ type VisitorsAppStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	BackendImage  string `json:"backendImage"`
 	FrontendImage string `json:"frontendImage"`
+
+	// LastBackup describes the last successful backup.
+	// +optional
+	LastBackup *BackupStatus `json:"lastBackup,omitempty"`
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the app's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
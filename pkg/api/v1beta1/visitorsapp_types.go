@@ -0,0 +1,436 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// VisitorsAppSpec defines the desired state of VisitorsApp
+type VisitorsAppSpec struct {
+	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Size is the number of backend replicas, unless spec.backend.replicas is
+	// set. It is the field scaled through the scale subresource.
+	Size int32 `json:"size"`
+
+	// Database selects and configures the visitors database.
+	// +optional
+	Database DatabaseSpec `json:"database,omitempty"`
+
+	// Backend configures the visitors-service tier.
+	// +optional
+	Backend BackendSpec `json:"backend,omitempty"`
+
+	// Frontend configures the visitors-webui tier.
+	// +optional
+	Frontend FrontendSpec `json:"frontend,omitempty"`
+
+	// Backup schedules logical backups of the visitors database.
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+
+	// Ingress exposes the web UI and the API under a host name, through an
+	// Ingress and optionally a Gateway API HTTPRoute.
+	// +optional
+	Ingress *IngressSpec `json:"ingress,omitempty"`
+
+	// DeletionPolicy decides what happens to the MySQL data when the app is
+	// deleted: Delete removes the data volume claims, Retain keeps them along
+	// with the generated credentials secret, and Snapshot dumps the database
+	// to spec.backup.targetPVC before removing the claims.
+	// +kubebuilder:default=Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// DeletionPolicy decides what happens to the MySQL data when the app is deleted
+// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+type DeletionPolicy string
+
+const (
+	DeletionPolicyDelete   DeletionPolicy = "Delete"
+	DeletionPolicyRetain   DeletionPolicy = "Retain"
+	DeletionPolicySnapshot DeletionPolicy = "Snapshot"
+)
+
+// DatabaseSpec selects the database used by the backend
+type DatabaseSpec struct {
+	// MySQL configures the in-cluster MySQL tier.
+	// +optional
+	MySQL MySQLSpec `json:"mysql,omitempty"`
+
+	// External points the backend at an existing MySQL server instead of
+	// running one in the cluster. spec.database.mysql must be left empty when set.
+	// +optional
+	External *ExternalDatabaseSpec `json:"external,omitempty"`
+}
+
+// ExternalDatabaseSpec describes a MySQL server managed outside of the operator
+type ExternalDatabaseSpec struct {
+	// Host name or address of the MySQL server.
+	Host string `json:"host"`
+
+	// Port of the MySQL server.
+	// +kubebuilder:default=3306
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// DatabaseName is the name of the visitors database on the server.
+	// +kubebuilder:default=visitors
+	// +optional
+	DatabaseName string `json:"databaseName,omitempty"`
+
+	// CredentialsSecret names a secret holding the database credentials
+	// under the username and password keys.
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// TierSpec holds the settings shared by every tier of the app.
+// Unset fields fall back to the operator defaults.
+type TierSpec struct {
+	// Image is the container image of the tier.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Replicas is the number of pods of the tier.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Resources are the compute resources of the tier container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Env lists extra environment variables for the tier container.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// NodeSelector constrains the tier pods to nodes with matching labels.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations of the tier pods.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Affinity scheduling rules of the tier pods.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+}
+
+// MySQLSpec configures the MySQL tier. Replicas default to 1, independently
+// of spec.size, and are capped at MaxMySQLReplicas since the pods don't
+// replicate data between each other.
+type MySQLSpec struct {
+	TierSpec `json:",inline"`
+
+	// CredentialsSecret names an existing secret holding the database
+	// credentials under the root-password, username and password keys.
+	// When empty, the operator generates a secret with random credentials.
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// RestoreFrom loads an existing dump into the database once MySQL is
+	// first ready, before the backend is deployed.
+	// +optional
+	RestoreFrom *RestoreSource `json:"restoreFrom,omitempty"`
+
+	// Storage enables persistent storage for the database. When set, MySQL
+	// runs as a StatefulSet with a volume claim template instead of a
+	// Deployment. An existing Deployment is replaced once its data has been
+	// copied to the volume.
+	// +optional
+	Storage *MySQLStorageSpec `json:"storage,omitempty"`
+
+	// PasswordRotation changes the password of the visitors database user
+	// on a schedule. Only the operator generated credentials are rotated.
+	// +optional
+	PasswordRotation *PasswordRotationSpec `json:"passwordRotation,omitempty"`
+}
+
+// PasswordRotationSpec configures the rotation of the visitors database user
+// password
+type PasswordRotationSpec struct {
+	// Interval between two rotations, such as 720h. The first rotation is
+	// due one interval after the app was created.
+	Interval metav1.Duration `json:"interval"`
+}
+
+// RestoreSource points at a dump of the visitors database
+type RestoreSource struct {
+	// ClaimName of the persistent volume claim holding the dump.
+	ClaimName string `json:"claimName"`
+
+	// File is the path of the dump on the volume. Dumps ending in .gz are
+	// decompressed, which matches the files written by scheduled backups.
+	File string `json:"file"`
+}
+
+// MySQLStorageSpec configures the persistent volume of the MySQL tier
+type MySQLStorageSpec struct {
+	// StorageClassName of the data volume claim. The cluster default storage
+	// class is used when empty.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Size of the data volume. Growing it expands the existing claims when
+	// the storage class allows volume expansion.
+	Size resource.Quantity `json:"size"`
+}
+
+// BackendSpec configures the backend tier. Replicas default to spec.size.
+type BackendSpec struct {
+	TierSpec `json:",inline"`
+
+	// Service configures the Service in front of the backend.
+	// +optional
+	Service ServiceSpec `json:"service,omitempty"`
+}
+
+// FrontendSpec configures the frontend tier. Replicas default to one.
+type FrontendSpec struct {
+	TierSpec `json:",inline"`
+
+	// Title shown by the web UI.
+	// +optional
+	Title string `json:"title,omitempty"`
+
+	// Service configures the Service in front of the frontend.
+	// +optional
+	Service ServiceSpec `json:"service,omitempty"`
+}
+
+// ServiceSpec configures the Service exposing a tier
+type ServiceSpec struct {
+	// Type of the Service, NodePort when empty.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// Port the Service listens on, the container port of the tier when unset.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// NodePort of a NodePort or LoadBalancer Service. The cluster allocates
+	// a free one when unset, which keeps several apps from colliding.
+	// +optional
+	NodePort int32 `json:"nodePort,omitempty"`
+
+	// Annotations of the Service, such as the load balancer settings of the
+	// cloud provider.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IngressSpec routes the path to the frontend Service and the api path below
+// it to the backend Service
+type IngressSpec struct {
+	// Host name the app is served under.
+	Host string `json:"host"`
+
+	// Path the web UI is served under, the API is served under its api
+	// sub-path. Defaults to /.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// TLSSecret names the secret holding the certificate of the host. The
+	// app is served over plain HTTP when empty.
+	// +optional
+	TLSSecret string `json:"tlsSecret,omitempty"`
+
+	// IngressClassName of the Ingress, the cluster default class when unset.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Gateway additionally routes the app through an HTTPRoute attached to
+	// the given Gateway. The Gateway API must be installed in the cluster.
+	// +optional
+	Gateway *GatewayReference `json:"gateway,omitempty"`
+}
+
+// GatewayReference points at the Gateway an HTTPRoute attaches to
+type GatewayReference struct {
+	// Name of the Gateway.
+	Name string `json:"name"`
+
+	// Namespace of the Gateway, the namespace of the app when empty.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// SectionName selects a listener of the Gateway.
+	// +optional
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// BackupSpec configures the scheduled backups of the visitors database
+type BackupSpec struct {
+	// Schedule of the backups, in cron format.
+	Schedule string `json:"schedule"`
+
+	// Retention is the number of backups of the app kept on the target
+	// volume. The dumps are named after the app, so several apps can share
+	// the volume.
+	// +kubebuilder:default=7
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Retention int32 `json:"retention,omitempty"`
+
+	// TargetPVC names the persistent volume claim the dumps are written to.
+	TargetPVC string `json:"targetPVC"`
+}
+
+// BackupStatus describes a completed backup
+type BackupStatus struct {
+	// CompletionTime of the backup.
+	CompletionTime metav1.Time `json:"completionTime"`
+
+	// Size of the compressed dump.
+	Size resource.Quantity `json:"size"`
+
+	// File is the name of the dump on the target volume.
+	File string `json:"file"`
+}
+
+// VisitorsAppStatus defines the observed state of VisitorsApp
+type VisitorsAppStatus struct {
+	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+	BackendImage  string `json:"backendImage"`
+	FrontendImage string `json:"frontendImage"`
+
+	// Replicas is the number of available backend pods.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Selector matches the backend pods, in the serialized label selector
+	// form expected by the scale subresource.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// LastBackup describes the last successful backup.
+	// +optional
+	LastBackup *BackupStatus `json:"lastBackup,omitempty"`
+
+	// LastPasswordRotation is the time the visitors database user password
+	// was last rotated.
+	// +optional
+	LastPasswordRotation *metav1.Time `json:"lastPasswordRotation,omitempty"`
+
+	// URL the web UI is served at when spec.ingress is set.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the app's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types reported in VisitorsAppStatus.Conditions.
+const (
+	// ConditionReady is true when every tier of the app is available.
+	ConditionReady = "Ready"
+	// ConditionMySQLReady is true when the MySQL tier accepts connections.
+	ConditionMySQLReady = "MySQLReady"
+	// ConditionExternalDatabaseReachable is true when the external database
+	// accepts TCP connections.
+	ConditionExternalDatabaseReachable = "ExternalDatabaseReachable"
+	// ConditionRestored is true once the dump referenced by
+	// spec.database.mysql.restoreFrom has been loaded into the database.
+	ConditionRestored = "Restored"
+	// ConditionStorageMigrated is set when spec.database.mysql.storage is
+	// added to an app running MySQL as a Deployment, or set on an app whose
+	// MySQL runs under its legacy name, it turns true once the data has been
+	// copied to the volume of the StatefulSet.
+	ConditionStorageMigrated = "StorageMigrated"
+	// ConditionPasswordRotated is set once spec.database.mysql.passwordRotation
+	// is configured, it is false while a rotation is in progress or failed.
+	ConditionPasswordRotated = "PasswordRotated"
+	// ConditionBackendAvailable is true when the backend Deployment is available.
+	ConditionBackendAvailable = "BackendAvailable"
+	// ConditionFrontendAvailable is true when the frontend Deployment is available.
+	ConditionFrontendAvailable = "FrontendAvailable"
+	// ConditionProgressing is true while the controller is rolling out changes.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true when the last reconcile failed.
+	ConditionDegraded = "Degraded"
+	// ConditionCleanedUp is set once the app is being deleted and turns true
+	// when spec.deletionPolicy has been carried out.
+	ConditionCleanedUp = "CleanedUp"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:subresource:scale:specpath=.spec.size,statuspath=.status.replicas,selectorpath=.status.selector
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Available",type=integer,JSONPath=`.status.replicas`,description="Available backend replicas"
+//+kubebuilder:printcolumn:name="Backend",type=string,JSONPath=`.status.backendImage`
+//+kubebuilder:printcolumn:name="Frontend",type=string,JSONPath=`.status.frontendImage`
+//+kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VisitorsApp is the Schema for the visitorsapps API
+type VisitorsApp struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VisitorsAppSpec   `json:"spec,omitempty"`
+	Status VisitorsAppStatus `json:"status,omitempty"`
+}
+
+// SetCondition sets the given condition on the status, stamping it with the
+// generation of the object.
+func (in *VisitorsApp) SetCondition(
+	conditionType string,
+	status metav1.ConditionStatus,
+	reason string,
+	message string,
+) {
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: in.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+//+kubebuilder:object:root=true
+
+// VisitorsAppList contains a list of VisitorsApp
+type VisitorsAppList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VisitorsApp `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VisitorsApp{}, &VisitorsAppList{})
+}
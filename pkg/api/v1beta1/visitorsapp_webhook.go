@@ -0,0 +1,426 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// Defaults of the spec fields, filled in by the defaulting webhook. Changing
+// one only affects the apps created or updated afterwards.
+const (
+	DefaultMySQLImage       = "mysql:5.7"
+	DefaultMySQLReplicas    = int32(1)
+	DefaultBackendImage     = "jdob/visitors-service:1.0.0"
+	DefaultFrontendImage    = "jdob/visitors-webui:1.0.0"
+	DefaultFrontendReplicas = int32(1)
+	DefaultDatabasePort     = int32(3306)
+	DefaultDatabaseName     = "visitors"
+	DefaultBackupRetention  = int32(7)
+	DefaultServiceType      = corev1.ServiceTypeNodePort
+	DefaultIngressPath      = "/"
+)
+
+// MaxMySQLReplicas bounds spec.database.mysql.replicas as long as the MySQL
+// pods don't replicate data between each other
+const MaxMySQLReplicas = int32(1)
+
+// maxTitleLength bounds spec.frontend.title, which ends up in the frontend environment
+const maxTitleLength = 256
+
+// minPasswordRotationInterval keeps the rotations from following each other
+// before the backend has rolled out the previous password
+const minPasswordRotationInterval = time.Hour
+
+// cronFieldPattern matches a single field of a standard cron schedule
+var cronFieldPattern = regexp.MustCompile(`^[0-9A-Za-z*?/,\-]+$`)
+
+// cronDescriptors are the predefined schedules accepted by CronJobs
+var cronDescriptors = map[string]bool{
+	"@yearly":   true,
+	"@annually": true,
+	"@monthly":  true,
+	"@weekly":   true,
+	"@daily":    true,
+	"@midnight": true,
+	"@hourly":   true,
+}
+
+// log is for logging in this package.
+var visitorsapplog = logf.Log.WithName("visitorsapp-resource")
+
+func (r *VisitorsApp) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-app-my-domain-v1beta1-visitorsapp,mutating=true,failurePolicy=fail,sideEffects=None,groups=app.my.domain,resources=visitorsapps,verbs=create;update,versions=v1beta1,name=mvisitorsapp.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &VisitorsApp{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// Fields already set are left alone, so existing apps keep the defaults they
+// were created with. The backend replicas are left empty since they follow
+// spec.size.
+func (r *VisitorsApp) Default() {
+	visitorsapplog.Info("default", "name", r.Name)
+
+	if external := r.Spec.Database.External; external != nil {
+		if external.Port == 0 {
+			external.Port = DefaultDatabasePort
+		}
+		if external.DatabaseName == "" {
+			external.DatabaseName = DefaultDatabaseName
+		}
+	} else {
+		defaultTier(&r.Spec.Database.MySQL.TierSpec, DefaultMySQLImage, DefaultMySQLReplicas)
+	}
+
+	if r.Spec.Backend.Image == "" {
+		r.Spec.Backend.Image = DefaultBackendImage
+	}
+	defaultTier(&r.Spec.Frontend.TierSpec, DefaultFrontendImage, DefaultFrontendReplicas)
+
+	for _, service := range []*ServiceSpec{&r.Spec.Backend.Service, &r.Spec.Frontend.Service} {
+		if service.Type == "" {
+			service.Type = DefaultServiceType
+		}
+	}
+
+	if r.Spec.Backup != nil && r.Spec.Backup.Retention == 0 {
+		r.Spec.Backup.Retention = DefaultBackupRetention
+	}
+	if r.Spec.DeletionPolicy == "" {
+		r.Spec.DeletionPolicy = DeletionPolicyDelete
+	}
+	if r.Spec.Ingress != nil && r.Spec.Ingress.Path == "" {
+		r.Spec.Ingress.Path = DefaultIngressPath
+	}
+}
+
+func defaultTier(tier *TierSpec, image string, replicas int32) {
+	if tier.Image == "" {
+		tier.Image = image
+	}
+	if tier.Replicas == nil {
+		tier.Replicas = &replicas
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-app-my-domain-v1beta1-visitorsapp,mutating=false,failurePolicy=fail,sideEffects=None,groups=app.my.domain,resources=visitorsapps,verbs=create;update,versions=v1beta1,name=vvisitorsapp.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &VisitorsApp{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *VisitorsApp) ValidateCreate() error {
+	visitorsapplog.Info("validate create", "name", r.Name)
+
+	return r.toAggregateError(r.validateSpec())
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *VisitorsApp) ValidateUpdate(old runtime.Object) error {
+	visitorsapplog.Info("validate update", "name", r.Name)
+
+	oldApp, ok := old.(*VisitorsApp)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a VisitorsApp but got a %T", old))
+	}
+
+	// Never get in the way of the finalizer removal, even if the app was
+	// created before a rule it now breaks
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	allErrs := r.validateSpec()
+	allErrs = append(allErrs, r.validateStorageUpdate(oldApp)...)
+	return r.toAggregateError(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *VisitorsApp) ValidateDelete() error {
+	return nil
+}
+
+func (r *VisitorsApp) toAggregateError(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("VisitorsApp").GroupKind(), r.Name, allErrs)
+}
+
+// validateSpec checks the field ranges and the rules spanning several fields
+func (r *VisitorsApp) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if r.Spec.Size < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("size"), r.Spec.Size,
+			"must be greater than or equal to 0"))
+	}
+	if len(r.Spec.Frontend.Title) > maxTitleLength {
+		allErrs = append(allErrs, field.TooLong(specPath.Child("frontend", "title"),
+			r.Spec.Frontend.Title, maxTitleLength))
+	}
+
+	allErrs = append(allErrs, validateTier(specPath.Child("database", "mysql"), r.Spec.Database.MySQL.TierSpec)...)
+	if replicas := r.Spec.Database.MySQL.Replicas; replicas != nil && *replicas > MaxMySQLReplicas {
+		// Each pod would start its own database and the Service would
+		// spread the writes across them
+		allErrs = append(allErrs, field.Invalid(specPath.Child("database", "mysql", "replicas"), *replicas,
+			"must be 0 or 1, MySQL pods don't replicate data between each other"))
+	}
+	allErrs = append(allErrs, validateTier(specPath.Child("backend"), r.Spec.Backend.TierSpec)...)
+	allErrs = append(allErrs, validateTier(specPath.Child("frontend"), r.Spec.Frontend.TierSpec)...)
+	allErrs = append(allErrs, r.validateDatabase(specPath)...)
+	allErrs = append(allErrs, validateService(specPath.Child("backend", "service"), r.Spec.Backend.Service)...)
+	allErrs = append(allErrs, validateService(specPath.Child("frontend", "service"), r.Spec.Frontend.Service)...)
+
+	if storage := r.Spec.Database.MySQL.Storage; storage != nil && storage.Size.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("database", "mysql", "storage", "size"),
+			storage.Size.String(), "must be greater than 0"))
+	}
+
+	if restore := r.Spec.Database.MySQL.RestoreFrom; restore != nil {
+		restorePath := specPath.Child("database", "mysql", "restoreFrom")
+		if restore.ClaimName == "" {
+			allErrs = append(allErrs, field.Required(restorePath.Child("claimName"), ""))
+		}
+		if restore.File == "" {
+			allErrs = append(allErrs, field.Required(restorePath.Child("file"), ""))
+		}
+	}
+
+	if rotation := r.Spec.Database.MySQL.PasswordRotation; rotation != nil {
+		rotationPath := specPath.Child("database", "mysql", "passwordRotation")
+		if rotation.Interval.Duration < minPasswordRotationInterval {
+			allErrs = append(allErrs, field.Invalid(rotationPath.Child("interval"), rotation.Interval.Duration.String(),
+				fmt.Sprintf("must be at least %s", minPasswordRotationInterval)))
+		}
+		if r.Spec.Database.MySQL.CredentialsSecret != "" {
+			allErrs = append(allErrs, field.Forbidden(rotationPath,
+				"only the operator generated credentials can be rotated, unset spec.database.mysql.credentialsSecret"))
+		}
+	}
+
+	if backup := r.Spec.Backup; backup != nil {
+		backupPath := specPath.Child("backup")
+		if err := validateSchedule(backup.Schedule); err != "" {
+			allErrs = append(allErrs, field.Invalid(backupPath.Child("schedule"), backup.Schedule, err))
+		}
+		if backup.TargetPVC == "" {
+			allErrs = append(allErrs, field.Required(backupPath.Child("targetPVC"),
+				"backups need a volume claim to write the dumps to"))
+		}
+	}
+
+	if ingress := r.Spec.Ingress; ingress != nil {
+		allErrs = append(allErrs, validateIngress(specPath.Child("ingress"), ingress)...)
+	}
+
+	if r.Spec.DeletionPolicy == DeletionPolicySnapshot && r.Spec.Backup == nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("deletionPolicy"), r.Spec.DeletionPolicy,
+			"the final snapshot is written to spec.backup.targetPVC, which must be set"))
+	}
+
+	return allErrs
+}
+
+// validateDatabase rejects the MySQL settings that have no effect once an
+// external database is used
+func (r *VisitorsApp) validateDatabase(specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	external := r.Spec.Database.External
+	if external == nil {
+		return allErrs
+	}
+
+	externalPath := specPath.Child("database", "external")
+	if external.Host == "" {
+		allErrs = append(allErrs, field.Required(externalPath.Child("host"), ""))
+	}
+	if external.Port < 1 || external.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(externalPath.Child("port"), external.Port,
+			"must be between 1 and 65535"))
+	}
+	if external.CredentialsSecret == "" {
+		allErrs = append(allErrs, field.Required(externalPath.Child("credentialsSecret"), ""))
+	}
+
+	mysqlPath := specPath.Child("database", "mysql")
+	if r.Spec.Database.MySQL.Storage != nil {
+		allErrs = append(allErrs, field.Forbidden(mysqlPath.Child("storage"),
+			"cannot be set together with spec.database.external"))
+	}
+	if r.Spec.Database.MySQL.CredentialsSecret != "" {
+		allErrs = append(allErrs, field.Forbidden(mysqlPath.Child("credentialsSecret"),
+			"cannot be set together with spec.database.external, use spec.database.external.credentialsSecret"))
+	}
+	if r.Spec.Database.MySQL.RestoreFrom != nil {
+		allErrs = append(allErrs, field.Forbidden(mysqlPath.Child("restoreFrom"),
+			"restoring into an external database is not supported"))
+	}
+	if r.Spec.Database.MySQL.PasswordRotation != nil {
+		allErrs = append(allErrs, field.Forbidden(mysqlPath.Child("passwordRotation"),
+			"the credentials of an external database are managed outside of the cluster"))
+	}
+	return allErrs
+}
+
+// validateStorageUpdate rejects the MySQL storage changes the operator can't
+// carry out on existing volume claims
+func (r *VisitorsApp) validateStorageUpdate(old *VisitorsApp) field.ErrorList {
+	var allErrs field.ErrorList
+	storagePath := field.NewPath("spec", "database", "mysql", "storage")
+
+	oldStorage, storage := old.Spec.Database.MySQL.Storage, r.Spec.Database.MySQL.Storage
+	if oldStorage == nil {
+		return allErrs
+	}
+	if storage == nil {
+		allErrs = append(allErrs, field.Forbidden(storagePath,
+			"cannot be removed once set, the data volumes would be abandoned"))
+		return allErrs
+	}
+
+	if storage.Size.Cmp(oldStorage.Size) < 0 {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("size"),
+			fmt.Sprintf("cannot be decreased from %s, volume claims can only grow", oldStorage.Size.String())))
+	}
+	if !equalStringPointers(storage.StorageClassName, oldStorage.StorageClassName) {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("storageClassName"),
+			"is immutable once storage is set"))
+	}
+	return allErrs
+}
+
+// validateIngress checks the host name and path the app is exposed under
+func validateIngress(ingressPath *field.Path, ingress *IngressSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if ingress.Host == "" {
+		allErrs = append(allErrs, field.Required(ingressPath.Child("host"), ""))
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(ingress.Host) {
+			allErrs = append(allErrs, field.Invalid(ingressPath.Child("host"), ingress.Host, msg))
+		}
+	}
+	if ingress.Path != "" && !strings.HasPrefix(ingress.Path, "/") {
+		allErrs = append(allErrs, field.Invalid(ingressPath.Child("path"), ingress.Path,
+			"must be an absolute path"))
+	}
+	if ingress.Gateway != nil && ingress.Gateway.Name == "" {
+		allErrs = append(allErrs, field.Required(ingressPath.Child("gateway", "name"), ""))
+	}
+	return allErrs
+}
+
+// validateService checks the ports of the Service of a tier
+func validateService(servicePath *field.Path, service ServiceSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if service.Port < 0 || service.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(servicePath.Child("port"), service.Port,
+			"must be between 1 and 65535"))
+	}
+	if service.NodePort == 0 {
+		return allErrs
+	}
+	if service.Type == corev1.ServiceTypeClusterIP {
+		allErrs = append(allErrs, field.Forbidden(servicePath.Child("nodePort"),
+			"cannot be set on a ClusterIP Service"))
+	} else if service.NodePort < 30000 || service.NodePort > 32767 {
+		allErrs = append(allErrs, field.Invalid(servicePath.Child("nodePort"), service.NodePort,
+			"must be in the default node port range, between 30000 and 32767"))
+	}
+	return allErrs
+}
+
+func validateTier(tierPath *field.Path, tier TierSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if tier.Image != "" && !imageHasTagOrDigest(tier.Image) {
+		allErrs = append(allErrs, field.Invalid(tierPath.Child("image"), tier.Image,
+			"must reference a tag or a digest, e.g. mysql:5.7"))
+	}
+	if tier.Replicas != nil && *tier.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(tierPath.Child("replicas"), *tier.Replicas,
+			"must be greater than or equal to 0"))
+	}
+	return allErrs
+}
+
+// imageHasTagOrDigest returns whether the image reference pins a tag or a
+// digest. The registry part may hold a port, so only the last path component
+// is looked at for the tag.
+func imageHasTagOrDigest(image string) bool {
+	if strings.ContainsAny(image, " \t\n") {
+		return false
+	}
+	if i := strings.Index(image, "@"); i >= 0 {
+		return i > 0 && i < len(image)-1
+	}
+
+	lastComponent := image[strings.LastIndex(image, "/")+1:]
+	i := strings.Index(lastComponent, ":")
+	return i > 0 && i < len(lastComponent)-1
+}
+
+// validateSchedule returns why the schedule isn't a valid cron expression,
+// or an empty string when it is
+func validateSchedule(schedule string) string {
+	schedule = strings.TrimSpace(schedule)
+	if strings.HasPrefix(schedule, "@") {
+		if !cronDescriptors[schedule] {
+			return "unknown schedule descriptor"
+		}
+		return ""
+	}
+
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return "must have 5 fields: minute, hour, day of month, month and day of week"
+	}
+	for _, f := range fields {
+		if !cronFieldPattern.MatchString(f) {
+			return fmt.Sprintf("invalid field %q", f)
+		}
+	}
+	return ""
+}
+
+func equalStringPointers(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
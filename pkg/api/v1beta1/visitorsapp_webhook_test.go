@@ -0,0 +1,446 @@
+package v1beta1
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newValidApp returns an app using every optional feature, which passes the
+// validation. Every field the defaulting sets is filled in.
+func newValidApp() *VisitorsApp {
+	mysqlReplicas := int32(1)
+	frontendReplicas := int32(2)
+	storageClass := "standard"
+	return &VisitorsApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: VisitorsAppSpec{
+			Size: 2,
+			Database: DatabaseSpec{
+				MySQL: MySQLSpec{
+					TierSpec: TierSpec{Image: "mysql:5.7", Replicas: &mysqlReplicas},
+					Storage: &MySQLStorageSpec{
+						StorageClassName: &storageClass,
+						Size:             resource.MustParse("1Gi"),
+					},
+					RestoreFrom:      &RestoreSource{ClaimName: "dumps", File: "dump.sql"},
+					PasswordRotation: &PasswordRotationSpec{Interval: metav1.Duration{Duration: 720 * time.Hour}},
+				},
+			},
+			Backend: BackendSpec{
+				TierSpec: TierSpec{Image: "registry:5000/visitors-service@sha256:abc"},
+				Service:  ServiceSpec{Type: corev1.ServiceTypeNodePort, Port: 8000, NodePort: 30685},
+			},
+			Frontend: FrontendSpec{
+				TierSpec: TierSpec{Image: "jdob/visitors-webui:1.0.0", Replicas: &frontendReplicas},
+				Service:  ServiceSpec{Type: corev1.ServiceTypeClusterIP, Port: 80},
+				Title:    "Visitors",
+			},
+			Backup: &BackupSpec{Schedule: "0 3 * * 1-5", Retention: 7, TargetPVC: "backups"},
+			Ingress: &IngressSpec{
+				Host:    "visitors.example.com",
+				Path:    "/visitors",
+				Gateway: &GatewayReference{Name: "gateway"},
+			},
+			DeletionPolicy: DeletionPolicySnapshot,
+		},
+	}
+}
+
+// useExternalDatabase switches the app to a valid external database, dropping
+// the MySQL settings that don't apply to it
+func useExternalDatabase(v *VisitorsApp) {
+	v.Spec.Database.MySQL.Storage = nil
+	v.Spec.Database.MySQL.RestoreFrom = nil
+	v.Spec.Database.MySQL.PasswordRotation = nil
+	v.Spec.Database.External = &ExternalDatabaseSpec{
+		Host:              "db.example.com",
+		Port:              3306,
+		CredentialsSecret: "credentials",
+	}
+}
+
+// invalidFields returns the fields an error of the validation points at
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an Invalid error, got %v", err)
+	}
+	var fields []string
+	for _, cause := range err.(apierrors.APIStatus).Status().Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	return fields
+}
+
+func TestValidateCreate(t *testing.T) {
+	negative := int32(-1)
+	two := int32(2)
+
+	tests := []struct {
+		name   string
+		modify func(*VisitorsApp)
+		// field is the one rejected, none when empty
+		field string
+	}{
+		{
+			name:   "valid",
+			modify: func(v *VisitorsApp) {},
+		},
+		{
+			name:   "valid external database",
+			modify: useExternalDatabase,
+		},
+		{
+			name:   "negative size",
+			modify: func(v *VisitorsApp) { v.Spec.Size = -1 },
+			field:  "spec.size",
+		},
+		{
+			name:   "title too long",
+			modify: func(v *VisitorsApp) { v.Spec.Frontend.Title = strings.Repeat("a", maxTitleLength+1) },
+			field:  "spec.frontend.title",
+		},
+		{
+			name:   "image without tag",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Image = "mysql" },
+			field:  "spec.database.mysql.image",
+		},
+		{
+			name:   "image with registry port but no tag",
+			modify: func(v *VisitorsApp) { v.Spec.Backend.Image = "registry:5000/visitors-service" },
+			field:  "spec.backend.image",
+		},
+		{
+			name:   "image with empty digest",
+			modify: func(v *VisitorsApp) { v.Spec.Frontend.Image = "visitors-webui@" },
+			field:  "spec.frontend.image",
+		},
+		{
+			name:   "negative tier replicas",
+			modify: func(v *VisitorsApp) { v.Spec.Backend.Replicas = &negative },
+			field:  "spec.backend.replicas",
+		},
+		{
+			name:   "several MySQL replicas",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Replicas = &two },
+			field:  "spec.database.mysql.replicas",
+		},
+		{
+			name: "external database without host",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.External.Host = ""
+			},
+			field: "spec.database.external.host",
+		},
+		{
+			name: "external database port out of range",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.External.Port = 65536
+			},
+			field: "spec.database.external.port",
+		},
+		{
+			name: "external database without credentials",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.External.CredentialsSecret = ""
+			},
+			field: "spec.database.external.credentialsSecret",
+		},
+		{
+			name: "external database with MySQL storage",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.MySQL.Storage = &MySQLStorageSpec{Size: resource.MustParse("1Gi")}
+			},
+			field: "spec.database.mysql.storage",
+		},
+		{
+			name: "external database with MySQL credentials",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.MySQL.CredentialsSecret = "credentials"
+			},
+			field: "spec.database.mysql.credentialsSecret",
+		},
+		{
+			name: "external database with restore",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.MySQL.RestoreFrom = &RestoreSource{ClaimName: "dumps", File: "dump.sql"}
+			},
+			field: "spec.database.mysql.restoreFrom",
+		},
+		{
+			name: "external database with password rotation",
+			modify: func(v *VisitorsApp) {
+				useExternalDatabase(v)
+				v.Spec.Database.MySQL.PasswordRotation = &PasswordRotationSpec{
+					Interval: metav1.Duration{Duration: 720 * time.Hour},
+				}
+			},
+			field: "spec.database.mysql.passwordRotation",
+		},
+		{
+			name:   "service port out of range",
+			modify: func(v *VisitorsApp) { v.Spec.Backend.Service.Port = 65536 },
+			field:  "spec.backend.service.port",
+		},
+		{
+			name:   "node port on a ClusterIP service",
+			modify: func(v *VisitorsApp) { v.Spec.Frontend.Service.NodePort = 30686 },
+			field:  "spec.frontend.service.nodePort",
+		},
+		{
+			name:   "node port out of range",
+			modify: func(v *VisitorsApp) { v.Spec.Backend.Service.NodePort = 80 },
+			field:  "spec.backend.service.nodePort",
+		},
+		{
+			name:   "empty storage",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Storage.Size = resource.MustParse("0") },
+			field:  "spec.database.mysql.storage.size",
+		},
+		{
+			name:   "restore without claim",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.RestoreFrom.ClaimName = "" },
+			field:  "spec.database.mysql.restoreFrom.claimName",
+		},
+		{
+			name:   "restore without file",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.RestoreFrom.File = "" },
+			field:  "spec.database.mysql.restoreFrom.file",
+		},
+		{
+			name: "password rotation too frequent",
+			modify: func(v *VisitorsApp) {
+				v.Spec.Database.MySQL.PasswordRotation.Interval = metav1.Duration{Duration: time.Minute}
+			},
+			field: "spec.database.mysql.passwordRotation.interval",
+		},
+		{
+			name:   "password rotation of user credentials",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.CredentialsSecret = "credentials" },
+			field:  "spec.database.mysql.passwordRotation",
+		},
+		{
+			name:   "unknown schedule descriptor",
+			modify: func(v *VisitorsApp) { v.Spec.Backup.Schedule = "@often" },
+			field:  "spec.backup.schedule",
+		},
+		{
+			name:   "schedule with missing fields",
+			modify: func(v *VisitorsApp) { v.Spec.Backup.Schedule = "0 3 * *" },
+			field:  "spec.backup.schedule",
+		},
+		{
+			name:   "schedule with invalid field",
+			modify: func(v *VisitorsApp) { v.Spec.Backup.Schedule = "0 3 * * mon;tue" },
+			field:  "spec.backup.schedule",
+		},
+		{
+			name:   "backup without target",
+			modify: func(v *VisitorsApp) { v.Spec.Backup.TargetPVC = "" },
+			field:  "spec.backup.targetPVC",
+		},
+		{
+			name:   "ingress without host",
+			modify: func(v *VisitorsApp) { v.Spec.Ingress.Host = "" },
+			field:  "spec.ingress.host",
+		},
+		{
+			name:   "ingress with invalid host",
+			modify: func(v *VisitorsApp) { v.Spec.Ingress.Host = "Visitors_App" },
+			field:  "spec.ingress.host",
+		},
+		{
+			name:   "ingress with relative path",
+			modify: func(v *VisitorsApp) { v.Spec.Ingress.Path = "visitors" },
+			field:  "spec.ingress.path",
+		},
+		{
+			name:   "gateway without name",
+			modify: func(v *VisitorsApp) { v.Spec.Ingress.Gateway.Name = "" },
+			field:  "spec.ingress.gateway.name",
+		},
+		{
+			name:   "snapshot without backup",
+			modify: func(v *VisitorsApp) { v.Spec.Backup = nil },
+			field:  "spec.deletionPolicy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newValidApp()
+			tt.modify(app)
+
+			var want []string
+			if tt.field != "" {
+				want = []string{tt.field}
+			}
+			if got := invalidFields(t, app.ValidateCreate()); !reflect.DeepEqual(got, want) {
+				t.Errorf("rejected fields = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	otherStorageClass := "fast"
+	now := metav1.Now()
+
+	tests := []struct {
+		name   string
+		modify func(*VisitorsApp)
+		// field is the one rejected, none when empty
+		field string
+	}{
+		{
+			name:   "unchanged",
+			modify: func(v *VisitorsApp) {},
+		},
+		{
+			name:   "storage grown",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Storage.Size = resource.MustParse("2Gi") },
+		},
+		{
+			name:   "storage removed",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Storage = nil },
+			field:  "spec.database.mysql.storage",
+		},
+		{
+			name:   "storage shrunk",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Storage.Size = resource.MustParse("512Mi") },
+			field:  "spec.database.mysql.storage.size",
+		},
+		{
+			name: "storage class changed",
+			modify: func(v *VisitorsApp) {
+				v.Spec.Database.MySQL.Storage.StorageClassName = &otherStorageClass
+			},
+			field: "spec.database.mysql.storage.storageClassName",
+		},
+		{
+			name:   "storage class unset",
+			modify: func(v *VisitorsApp) { v.Spec.Database.MySQL.Storage.StorageClassName = nil },
+			field:  "spec.database.mysql.storage.storageClassName",
+		},
+		{
+			name:   "invalid spec",
+			modify: func(v *VisitorsApp) { v.Spec.Size = -1 },
+			field:  "spec.size",
+		},
+		{
+			name: "invalid app being deleted",
+			modify: func(v *VisitorsApp) {
+				v.DeletionTimestamp = &now
+				v.Spec.Size = -1
+				v.Spec.Database.MySQL.Storage = nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := newValidApp()
+			app := old.DeepCopy()
+			tt.modify(app)
+
+			var want []string
+			if tt.field != "" {
+				want = []string{tt.field}
+			}
+			if got := invalidFields(t, app.ValidateUpdate(old)); !reflect.DeepEqual(got, want) {
+				t.Errorf("rejected fields = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateRejectsOtherKinds(t *testing.T) {
+	err := newValidApp().ValidateUpdate(&corev1.Secret{})
+	if !apierrors.IsBadRequest(err) {
+		t.Errorf("expected a BadRequest error, got %v", err)
+	}
+}
+
+// The defaults are recorded on an empty spec, and the values the user set are
+// kept
+func TestDefault(t *testing.T) {
+	mysqlReplicas := DefaultMySQLReplicas
+	frontendReplicas := DefaultFrontendReplicas
+
+	app := &VisitorsApp{
+		Spec: VisitorsAppSpec{
+			Backup:  &BackupSpec{Schedule: "@daily", TargetPVC: "backups"},
+			Ingress: &IngressSpec{Host: "visitors.example.com"},
+		},
+	}
+	app.Default()
+	want := VisitorsAppSpec{
+		Database: DatabaseSpec{
+			MySQL: MySQLSpec{TierSpec: TierSpec{Image: DefaultMySQLImage, Replicas: &mysqlReplicas}},
+		},
+		Backend: BackendSpec{
+			TierSpec: TierSpec{Image: DefaultBackendImage},
+			Service:  ServiceSpec{Type: DefaultServiceType},
+		},
+		Frontend: FrontendSpec{
+			TierSpec: TierSpec{Image: DefaultFrontendImage, Replicas: &frontendReplicas},
+			Service:  ServiceSpec{Type: DefaultServiceType},
+		},
+		Backup:         &BackupSpec{Schedule: "@daily", Retention: DefaultBackupRetention, TargetPVC: "backups"},
+		Ingress:        &IngressSpec{Host: "visitors.example.com", Path: DefaultIngressPath},
+		DeletionPolicy: DeletionPolicyDelete,
+	}
+	if !reflect.DeepEqual(app.Spec, want) {
+		t.Errorf("defaulted spec = %+v, want %+v", app.Spec, want)
+	}
+
+	// Defaulting the app again, or an app the user filled in, changes nothing
+	for _, spec := range []VisitorsAppSpec{want, newValidApp().Spec} {
+		app := &VisitorsApp{Spec: *spec.DeepCopy()}
+		app.Default()
+		if !reflect.DeepEqual(app.Spec, spec) {
+			t.Errorf("defaulting changed the spec to %+v, want %+v", app.Spec, spec)
+		}
+	}
+}
+
+// An external database gets its defaults instead of the MySQL ones
+func TestDefaultExternalDatabase(t *testing.T) {
+	app := &VisitorsApp{
+		Spec: VisitorsAppSpec{
+			Database: DatabaseSpec{
+				External: &ExternalDatabaseSpec{Host: "db.example.com", CredentialsSecret: "credentials"},
+			},
+		},
+	}
+	app.Default()
+
+	want := ExternalDatabaseSpec{
+		Host:              "db.example.com",
+		Port:              DefaultDatabasePort,
+		DatabaseName:      DefaultDatabaseName,
+		CredentialsSecret: "credentials",
+	}
+	if *app.Spec.Database.External != want {
+		t.Errorf("defaulted external database = %+v, want %+v", *app.Spec.Database.External, want)
+	}
+	if mysql := app.Spec.Database.MySQL; !reflect.DeepEqual(mysql, MySQLSpec{}) {
+		t.Errorf("MySQL defaults recorded for an external database: %+v", mysql)
+	}
+}
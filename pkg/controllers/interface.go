@@ -3,52 +3,63 @@ package controllers
 import (
 	"context"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 type ensureWorkloadDirector = interface {
-	SetEnsurer(ensurer workloadEnsurer)
-	EnsureMysql(
+	EnsureTier(
+		ctx context.Context,
+		ensurer workloadEnsurer,
+		name string,
+		readyCondition string,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
-		scheme *runtime.Scheme,
-	) (*reconcile.Result, error)
-	EnsureBackend(
-		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
-		scheme *runtime.Scheme,
-	) (*reconcile.Result, error)
-	EnsureFrontend(
-		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 }
 
 type workloadEnsurer = interface {
 	EnsureDeployment(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 	EnsureService(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 	EnsureSecret(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
-	UpdateStatus(instance *appv1alpha1.VisitorsApp) error
-	HandleWorkloadChanges(
-		instance *appv1alpha1.VisitorsApp,
+	UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error
+	CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool
+}
+
+// tier is a step of the reconcile, ensured once the tiers it depends on are ready
+type tier = interface {
+	Name() string
+	DependsOn() []string
+	ReadyCondition() string
+	Ensure(
+		ctx context.Context,
+		request reconcile.Request,
+		instance *appv1beta1.VisitorsApp,
+		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
-	CheckWorkload(instance *appv1alpha1.VisitorsApp) bool
+}
+
+// tierPipeline holds the tiers of the app in dependency order
+type tierPipeline = interface {
+	Tiers() []tier
 }
 
 type Controller interface {
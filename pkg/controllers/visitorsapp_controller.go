@@ -18,37 +18,66 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	"example.com/m/v2/pkg/workload_ensurers"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-var log = logf.Log.WithName("controller_visitorsapp")
+// cleanupFinalizer holds the deletion of an instance until its deletion
+// policy has been carried out
+const cleanupFinalizer = "app.my.domain/cleanup"
 
 // VisitorsAppController reconciles a VisitorsApp object
 type VisitorsAppController struct {
-	Client                 client.Client
-	Scheme                 *runtime.Scheme
-	ensureWorkloadDirector ensureWorkloadDirector
-	mysqlEnsurer           workloadEnsurer
-	backendEnsurer         workloadEnsurer
-	frontendEnsurer        workloadEnsurer
+	Client                  client.Client
+	Scheme                  *runtime.Scheme
+	Recorder                record.EventRecorder
+	reconcileTimeout        time.Duration
+	maxConcurrentReconciles int
+	ensureWorkloadDirector  ensureWorkloadDirector
+	tierPipeline            tierPipeline
+	cleanupEnsurer          workloadEnsurer
 }
 
 //+kubebuilder:rbac:groups=app.my.domain,resources=visitorsapps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=app.my.domain,resources=visitorsapps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=app.my.domain,resources=visitorsapps/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -60,74 +89,374 @@ type VisitorsAppController struct {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.11.0/pkg/reconcile
 func (r *VisitorsAppController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	//reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
-	//reqLogger.Info("Reconciling VisitorsApp")
+	// The logger of the context already carries the namespace and name of
+	// the request, the director adds the tier being ensured
+	logger := logf.FromContext(ctx)
+	logger.Info("Reconciling VisitorsApp")
+
+	// Bound the whole reconcile, including the status update, so that a slow
+	// API server or database can't hold a worker forever
+	if r.reconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.reconcileTimeout)
+		defer cancel()
+	}
 
 	// Fetch the VisitorsApp instance
-	visitorAppInstance := &appv1alpha1.VisitorsApp{}
-	err := r.Client.Get(context.TODO(), req.NamespacedName, visitorAppInstance)
+	visitorAppInstance := &appv1beta1.VisitorsApp{}
+	err := r.Client.Get(ctx, req.NamespacedName, visitorAppInstance)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Owned objects are automatically garbage collected, the rest is
+			// handled by the cleanup finalizer.
 			// Return and don't requeue
+			logger.V(1).Info("VisitorsApp not found, ignoring")
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
-	var result *reconcile.Result
+	if !visitorAppInstance.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, req, visitorAppInstance)
+	}
 
-	// == MySQL ==========
-	r.ensureWorkloadDirector.SetEnsurer(r.mysqlEnsurer)
-	result, err = r.ensureWorkloadDirector.EnsureMysql(req, visitorAppInstance, r.Scheme)
-	if result != nil {
-		return *result, err
+	if !controllerutil.ContainsFinalizer(visitorAppInstance, cleanupFinalizer) {
+		logger.Info("Adding the cleanup finalizer")
+		controllerutil.AddFinalizer(visitorAppInstance, cleanupFinalizer)
+		if err := r.Client.Update(ctx, visitorAppInstance); err != nil {
+			return reconcile.Result{}, err
+		}
 	}
 
-	// == Visitors Backend  ==========
-	r.ensureWorkloadDirector.SetEnsurer(r.backendEnsurer)
-	result, err = r.ensureWorkloadDirector.EnsureBackend(req, visitorAppInstance, r.Scheme)
-	if result != nil {
-		return *result, err
+	result, err := r.ensureWorkloads(ctx, req, visitorAppInstance)
+
+	// Persist the conditions collected by the ensurers, whatever the outcome
+	if statusErr := r.updateStatus(ctx, visitorAppInstance, err); statusErr != nil && err == nil {
+		return reconcile.Result{}, statusErr
+	}
+	return result, err
+}
+
+// ensureWorkloads ensures the tiers in waves: every tier whose dependencies
+// are ready runs in parallel with the others of its wave, on its own copy of
+// the instance. A tier that isn't ready holds back the tiers depending on it,
+// not the independent ones.
+func (r *VisitorsAppController) ensureWorkloads(
+	ctx context.Context,
+	req ctrl.Request,
+	visitorAppInstance *appv1beta1.VisitorsApp,
+) (reconcile.Result, error) {
+	ready := map[string]bool{}
+	held := map[string]bool{}
+	var results []reconcile.Result
+	var errs []error
+
+	pending := r.tierPipeline.Tiers()
+	for len(pending) > 0 {
+		var wave, next []tier
+		for _, tier := range pending {
+			switch tierState(tier, ready, held) {
+			case tierRunnable:
+				wave = append(wave, tier)
+			case tierHeld:
+				held[tier.Name()] = true
+			default:
+				next = append(next, tier)
+			}
+		}
+		if len(wave) == 0 {
+			// Only tiers held back by their dependencies are left
+			break
+		}
+
+		outcomes := make([]tierOutcome, len(wave))
+		var wg sync.WaitGroup
+		for i := range wave {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				instance := visitorAppInstance.DeepCopy()
+				result, err := wave[i].Ensure(ctx, req, instance, r.Scheme)
+				outcomes[i] = tierOutcome{instance: instance, result: result, err: err}
+			}(i)
+		}
+		wg.Wait()
+
+		// Merge in pipeline order so the outcome doesn't depend on scheduling
+		before := visitorAppInstance.Status.DeepCopy()
+		for i, tier := range wave {
+			outcome := outcomes[i]
+			mergeStatus(&visitorAppInstance.Status, before, &outcome.instance.Status)
+			if outcome.result == nil {
+				ready[tier.Name()] = true
+				continue
+			}
+			held[tier.Name()] = true
+			results = append(results, *outcome.result)
+			if outcome.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", tier.Name(), outcome.err))
+			}
+		}
+		pending = next
+	}
+
+	if len(errs) > 0 {
+		return reconcile.Result{}, utilerrors.NewAggregate(errs)
+	}
+
+	// == Finish ==========
+	// Requeue as soon as the first tier asked for it, if any did
+	return earliestResult(results), nil
+}
+
+type tierOutcome struct {
+	instance *appv1beta1.VisitorsApp
+	result   *reconcile.Result
+	err      error
+}
+
+const (
+	tierWaiting = iota
+	tierRunnable
+	tierHeld
+)
+
+// tierState tells whether all the dependencies of the tier are ready, or one
+// of them is held back, in which case the tier is too
+func tierState(t tier, ready map[string]bool, held map[string]bool) int {
+	state := tierRunnable
+	for _, dependency := range t.DependsOn() {
+		if held[dependency] {
+			return tierHeld
+		}
+		if !ready[dependency] {
+			state = tierWaiting
+		}
+	}
+	return state
+}
+
+// earliestResult combines the results of the tiers that weren't ready into
+// the one requeueing the soonest
+func earliestResult(results []reconcile.Result) reconcile.Result {
+	combined := reconcile.Result{}
+	for _, result := range results {
+		if result.RequeueAfter > 0 &&
+			(combined.RequeueAfter == 0 || result.RequeueAfter < combined.RequeueAfter) {
+			combined.RequeueAfter = result.RequeueAfter
+		}
+		combined.Requeue = combined.Requeue || result.Requeue
+	}
+	return combined
+}
+
+// mergeStatus copies into status what a tier changed on its copy of it,
+// compared to the status the wave started from. Tiers of a wave don't share
+// conditions or status fields, so their changes don't overlap.
+func mergeStatus(status, before, changed *appv1beta1.VisitorsAppStatus) {
+	for _, condition := range changed.Conditions {
+		previous := meta.FindStatusCondition(before.Conditions, condition.Type)
+		if previous == nil || *previous != condition {
+			meta.SetStatusCondition(&status.Conditions, condition)
+		}
+	}
+	for _, condition := range before.Conditions {
+		if meta.FindStatusCondition(changed.Conditions, condition.Type) == nil {
+			meta.RemoveStatusCondition(&status.Conditions, condition.Type)
+		}
 	}
 
-	// == Visitors Frontend ==========
-	r.ensureWorkloadDirector.SetEnsurer(r.frontendEnsurer)
-	result, err = r.ensureWorkloadDirector.EnsureFrontend(req, visitorAppInstance, r.Scheme)
+	if changed.BackendImage != before.BackendImage {
+		status.BackendImage = changed.BackendImage
+	}
+	if changed.FrontendImage != before.FrontendImage {
+		status.FrontendImage = changed.FrontendImage
+	}
+	if changed.Replicas != before.Replicas {
+		status.Replicas = changed.Replicas
+	}
+	if changed.Selector != before.Selector {
+		status.Selector = changed.Selector
+	}
+	if !equality.Semantic.DeepEqual(changed.LastBackup, before.LastBackup) {
+		status.LastBackup = changed.LastBackup
+	}
+	if !equality.Semantic.DeepEqual(changed.LastPasswordRotation, before.LastPasswordRotation) {
+		status.LastPasswordRotation = changed.LastPasswordRotation
+	}
+	if changed.URL != before.URL {
+		status.URL = changed.URL
+	}
+}
+
+// finalize carries out the deletion policy of the instance and then removes
+// the finalizer, letting the owned objects be garbage collected.
+func (r *VisitorsAppController) finalize(
+	ctx context.Context,
+	req ctrl.Request,
+	visitorAppInstance *appv1beta1.VisitorsApp,
+) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(visitorAppInstance, cleanupFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	logf.FromContext(ctx).Info("Carrying out the deletion policy", "policy", visitorAppInstance.Spec.DeletionPolicy)
+	result, err := r.ensureWorkloadDirector.EnsureTier(ctx, r.cleanupEnsurer, "cleanup", "",
+		req, visitorAppInstance, r.Scheme)
+
+	// Report the cleanup progress, the status goes away with the finalizer
+	if statusErr := r.updateStatus(ctx, visitorAppInstance, err); statusErr != nil && err == nil {
+		return reconcile.Result{}, statusErr
+	}
 	if result != nil {
 		return *result, err
 	}
 
-	// == Finish ==========
-	// Everything went fine, don't requeue
+	controllerutil.RemoveFinalizer(visitorAppInstance, cleanupFinalizer)
+	if err := r.Client.Update(ctx, visitorAppInstance); err != nil {
+		return reconcile.Result{}, err
+	}
+	r.Recorder.Eventf(visitorAppInstance, corev1.EventTypeNormal, "CleanedUp",
+		"Carried out the %s deletion policy", visitorAppInstance.Spec.DeletionPolicy)
 	return reconcile.Result{}, nil
 }
 
+// updateStatus derives the aggregate Ready, Progressing and Degraded conditions
+// from the per-tier conditions and writes the status of the instance.
+func (r *VisitorsAppController) updateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp, reconcileErr error) error {
+	var notReady []string
+	for _, tier := range r.tierPipeline.Tiers() {
+		conditionType := tier.ReadyCondition()
+		if conditionType != "" && !meta.IsStatusConditionTrue(instance.Status.Conditions, conditionType) {
+			notReady = append(notReady, conditionType)
+		}
+	}
+
+	wasReady := meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionReady)
+
+	if reconcileErr != nil {
+		instance.SetCondition(appv1beta1.ConditionDegraded, metav1.ConditionTrue,
+			"ReconcileFailed", reconcileErr.Error())
+		r.Recorder.Event(instance, corev1.EventTypeWarning, "ReconcileFailed", reconcileErr.Error())
+	} else {
+		instance.SetCondition(appv1beta1.ConditionDegraded, metav1.ConditionFalse,
+			"ReconcileSucceeded", "The last reconcile succeeded")
+	}
+
+	if len(notReady) == 0 {
+		instance.SetCondition(appv1beta1.ConditionReady, metav1.ConditionTrue,
+			"AllTiersReady", "All tiers are ready")
+		if !wasReady {
+			r.Recorder.Event(instance, corev1.EventTypeNormal, "Ready", "All tiers are ready")
+		}
+		instance.SetCondition(appv1beta1.ConditionProgressing, metav1.ConditionFalse,
+			"RolloutComplete", "All tiers are rolled out")
+	} else {
+		message := "Waiting for " + strings.Join(notReady, ", ")
+		instance.SetCondition(appv1beta1.ConditionReady, metav1.ConditionFalse,
+			"TiersNotReady", message)
+		if wasReady {
+			r.Recorder.Event(instance, corev1.EventTypeWarning, "NotReady", message)
+		}
+		if reconcileErr != nil {
+			instance.SetCondition(appv1beta1.ConditionProgressing, metav1.ConditionFalse,
+				"RolloutFailed", reconcileErr.Error())
+		} else {
+			instance.SetCondition(appv1beta1.ConditionProgressing, metav1.ConditionTrue,
+				"RolloutInProgress", message)
+		}
+	}
+
+	instance.Status.ObservedGeneration = instance.Generation
+	return r.Client.Status().Update(ctx, instance)
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *VisitorsAppController) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&appv1alpha1.VisitorsApp{}).
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&appv1beta1.VisitorsApp{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.maxConcurrentReconciles}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
 		Owns(&corev1.Service{}).
-		Complete(r)
+		// The generated credentials secret is owned, the ones referenced
+		// by the spec are watched
+		Owns(&corev1.Secret{}).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.appsReferencingSecret),
+		).
+		Owns(&batchv1.CronJob{}).
+		Owns(&batchv1.Job{}).
+		Owns(&networkingv1.Ingress{})
+
+	// Watching a kind the API server doesn't serve keeps the manager from
+	// starting, so routes are only watched when the Gateway API is installed.
+	// Installing it later takes a restart of the operator.
+	_, err := mgr.GetRESTMapper().RESTMapping(workload_ensurers.HTTPRouteGVK.GroupKind(), workload_ensurers.HTTPRouteGVK.Version)
+	if err == nil {
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(workload_ensurers.HTTPRouteGVK)
+		builder = builder.Owns(route)
+	} else if meta.IsNoMatchError(err) {
+		mgr.GetLogger().Info("The Gateway API isn't installed, HTTPRoutes aren't watched")
+	} else {
+		return err
+	}
+	return builder.Complete(r)
+}
+
+// appsReferencingSecret returns a request for every VisitorsApp of the
+// secret's namespace whose spec references the secret
+func (r *VisitorsAppController) appsReferencingSecret(secret client.Object) []reconcile.Request {
+	apps := &appv1beta1.VisitorsAppList{}
+	err := r.Client.List(context.Background(), apps, client.InNamespace(secret.GetNamespace()))
+	if err != nil {
+		logf.Log.Error(err, "Failed to list the VisitorsApps referencing a secret",
+			"namespace", secret.GetNamespace(), "secret", secret.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, app := range apps.Items {
+		if referencesSecret(&app, secret.GetName()) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: app.Name, Namespace: app.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
+// referencesSecret returns whether the spec of the instance references the
+// named secret
+func referencesSecret(instance *appv1beta1.VisitorsApp, name string) bool {
+	if instance.Spec.Database.External != nil {
+		return instance.Spec.Database.External.CredentialsSecret == name
+	}
+	return instance.Spec.Database.MySQL.CredentialsSecret == name
 }
 
 func NewVisitorsAppController(
 	cli client.Client,
 	scheme *runtime.Scheme,
+	recorder record.EventRecorder,
+	reconcileTimeout time.Duration,
+	maxConcurrentReconciles int,
 	ensureWorkloadDirector ensureWorkloadDirector,
-	mysqlEnsurer workloadEnsurer,
-	backendEnsurer workloadEnsurer,
-	frontendEnsurer workloadEnsurer,
+	tierPipeline tierPipeline,
+	cleanupEnsurer workloadEnsurer,
 ) Controller {
 	return &VisitorsAppController{
-		Client:                 cli,
-		Scheme:                 scheme,
-		ensureWorkloadDirector: ensureWorkloadDirector,
-		mysqlEnsurer:           mysqlEnsurer,
-		backendEnsurer:         backendEnsurer,
-		frontendEnsurer:        frontendEnsurer,
+		Client:                  cli,
+		Scheme:                  scheme,
+		Recorder:                recorder,
+		reconcileTimeout:        reconcileTimeout,
+		maxConcurrentReconciles: maxConcurrentReconciles,
+		ensureWorkloadDirector:  ensureWorkloadDirector,
+		tierPipeline:            tierPipeline,
+		cleanupEnsurer:          cleanupEnsurer,
 	}
 }
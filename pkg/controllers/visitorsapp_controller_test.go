@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	"example.com/m/v2/pkg/workload_ensurers"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// stubEnsurer records whether its workload was applied and reports it as
+// ready or not
+type stubEnsurer struct {
+	ready   bool
+	applied bool
+}
+
+func (s *stubEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	s.applied = true
+	return nil, nil
+}
+
+func (s *stubEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (s *stubEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (s *stubEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	return nil
+}
+
+func (s *stubEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return s.ready
+}
+
+// A backend that isn't ready requeues the reconcile, but doesn't hold back
+// the frontend ensured in the same wave
+func TestEnsureWorkloadsBackendRequeueDoesNotHoldFrontend(t *testing.T) {
+	mysql := &stubEnsurer{ready: true}
+	backend := &stubEnsurer{ready: false}
+	frontend := &stubEnsurer{ready: true}
+
+	pipeline, err := workload_ensurers.NewTierPipeline(
+		workload_ensurers.NewEnsureWorkloadDirector(),
+		workload_ensurers.TierDefinition{
+			Name:           "mysql",
+			ReadyCondition: appv1beta1.ConditionMySQLReady,
+			Ensurer:        mysql,
+		},
+		workload_ensurers.TierDefinition{
+			Name:           "backend",
+			DependsOn:      []string{"mysql"},
+			ReadyCondition: appv1beta1.ConditionBackendAvailable,
+			Ensurer:        backend,
+		},
+		workload_ensurers.TierDefinition{
+			Name:           "frontend",
+			DependsOn:      []string{"mysql"},
+			ReadyCondition: appv1beta1.ConditionFrontendAvailable,
+			Ensurer:        frontend,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &VisitorsAppController{Scheme: runtime.NewScheme(), tierPipeline: pipeline}
+	instance := &appv1beta1.VisitorsApp{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "app", Namespace: "default"}}
+
+	result, err := r.ensureWorkloads(context.Background(), req, instance)
+	if err != nil {
+		t.Fatalf("ensureWorkloads() error = %v", err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Errorf("ensureWorkloads() = %+v, want a requeue for the backend", result)
+	}
+	if !backend.applied || !frontend.applied {
+		t.Errorf("applied backend = %v, frontend = %v, want both", backend.applied, frontend.applied)
+	}
+	if !meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionFrontendAvailable) {
+		t.Errorf("%s isn't true", appv1beta1.ConditionFrontendAvailable)
+	}
+	if !meta.IsStatusConditionFalse(instance.Status.Conditions, appv1beta1.ConditionBackendAvailable) {
+		t.Errorf("%s isn't false", appv1beta1.ConditionBackendAvailable)
+	}
+}
+
+// mergeStatus carries over a change of any status field a tier may set, a
+// field added to VisitorsAppStatus fails this test until it is handled
+func TestMergeStatusCoversEveryField(t *testing.T) {
+	now := metav1.NewTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	// sample has a value for every field
+	sample := appv1beta1.VisitorsAppStatus{
+		BackendImage:  "backend:1",
+		FrontendImage: "frontend:1",
+		Replicas:      2,
+		Selector:      "app=visitors",
+		LastBackup: &appv1beta1.BackupStatus{
+			CompletionTime: now,
+			Size:           resource.MustParse("1Ki"),
+			File:           "app_20220101000000.sql.gz",
+		},
+		LastPasswordRotation: &now,
+		URL:                  "http://visitors.example.com/",
+		ObservedGeneration:   3,
+		Conditions: []metav1.Condition{{
+			Type:               appv1beta1.ConditionMySQLReady,
+			Status:             metav1.ConditionTrue,
+			Reason:             "Ready",
+			LastTransitionTime: now,
+		}},
+	}
+	// ObservedGeneration is set by the reconcile itself, not by the tiers
+	notSetByTiers := map[string]bool{"ObservedGeneration": true}
+
+	fields := reflect.TypeOf(sample)
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Name
+		if notSetByTiers[name] {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			value := reflect.ValueOf(sample).Field(i)
+			if value.IsZero() {
+				t.Fatalf("give %s a value in the sample status", name)
+			}
+
+			before := appv1beta1.VisitorsAppStatus{}
+			changed := appv1beta1.VisitorsAppStatus{}
+			reflect.ValueOf(&changed).Elem().Field(i).Set(value)
+			status := appv1beta1.VisitorsAppStatus{}
+			mergeStatus(&status, &before, &changed)
+
+			if got := reflect.ValueOf(status).Field(i); !equality.Semantic.DeepEqual(got.Interface(), value.Interface()) {
+				t.Errorf("mergeStatus() left %s at %v, want %v", name, got, value)
+			}
+		})
+	}
+}
@@ -2,109 +2,112 @@ package workload_ensurers
 
 import (
 	"context"
-	"time"
+	"strconv"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 type backendEnsurer struct {
-	client            client.Client
-	port              int
-	servicePort       int
-	image             string
-	mysqlAuthName     string
-	mysqlServiceName  string
-	deploymentPostfix string
-	servicePostfix    string
+	client              client.Client
+	recorder            record.EventRecorder
+	port                int
+	image               string
+	mysqlAuthPostfix    string
+	mysqlServicePostfix string
+	deploymentPostfix   string
+	servicePostfix      string
 }
 
 func (b *backendEnsurer) EnsureDeployment(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureDeployment(request, instance, b.backendDeployment(instance, scheme), b.client)
+	database := visitorsDatabase(instance, b.mysqlServicePostfix, b.mysqlAuthPostfix)
+	credentialsHash, err := secretHash(ctx, b.client, database.authSecret, instance.Namespace)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	return ensureDeployment(ctx, request, instance, b.backendDeployment(instance, scheme, credentialsHash), b.client, b.recorder)
 }
 
 func (b *backendEnsurer) EnsureService(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureService(request, instance, b.backendService(instance, scheme), b.client)
+	return ensureService(ctx, request, instance, b.backendService(instance, scheme), b.client, b.recorder)
 }
 
 func (b *backendEnsurer) EnsureSecret(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
 	return nil, nil
 }
 
-func (b *backendEnsurer) CheckWorkload(v *appv1alpha1.VisitorsApp) bool {
-	return true
+// CheckWorkload returns whether all backend replicas are available
+func (b *backendEnsurer) CheckWorkload(ctx context.Context, v *appv1beta1.VisitorsApp) bool {
+	return deploymentAvailable(ctx, b.client, v.Name+b.deploymentPostfix, v.Namespace)
 }
 
-func (b *backendEnsurer) UpdateStatus(instance *appv1alpha1.VisitorsApp) error {
-	instance.Status.BackendImage = b.image
-	err := b.client.Status().Update(context.TODO(), instance)
-	return err
-}
+// UpdateStatus records the backend image, available replicas and pod selector
+// on the instance, the last two back the scale subresource. The status itself
+// is written by the controller once the reconcile is over.
+func (b *backendEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	instance.Status.BackendImage = tierImage(instance.Spec.Backend.TierSpec, b.image)
+	instance.Status.Selector = k8slabels.SelectorFromSet(labels(instance, "backend")).String()
 
-func (b *backendEnsurer) HandleWorkloadChanges(
-	instance *appv1alpha1.VisitorsApp,
-) (*reconcile.Result, error) {
-	found := &appsv1.Deployment{}
-	err := b.client.Get(context.TODO(), types.NamespacedName{
+	deployment := &appsv1.Deployment{}
+	err := b.client.Get(ctx, types.NamespacedName{
 		Name:      instance.Name + b.deploymentPostfix,
 		Namespace: instance.Namespace,
-	}, found)
-	if err != nil {
-		// The deployment may not have been created yet, so requeue
-		return &reconcile.Result{RequeueAfter: 5 * time.Second}, err
+	}, deployment)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
 	}
-
-	size := instance.Spec.Size
-
-	if size != *found.Spec.Replicas {
-		found.Spec.Replicas = &size
-		err = b.client.Update(context.TODO(), found)
-		if err != nil {
-			//log.Error(err, "Failed to update Deployment.", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
-			return &reconcile.Result{}, err
-		}
-		// Spec updated - return and requeue
-		return &reconcile.Result{Requeue: true}, nil
-	}
-
-	return nil, nil
+	instance.Status.Replicas = deployment.Status.AvailableReplicas
+	return nil
 }
 
-func (b *backendEnsurer) backendDeployment(v *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *appsv1.Deployment {
+// backendDeployment builds the backend deployment, its pod template is
+// annotated with the hash of the credentials secret so that the pods roll
+// when the secret changes
+func (b *backendEnsurer) backendDeployment(
+	v *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+	credentialsHash string,
+) *appsv1.Deployment {
 	labels := labels(v, "backend")
-	size := v.Spec.Size
+
+	database := visitorsDatabase(v, b.mysqlServicePostfix, b.mysqlAuthPostfix)
 
 	userSecret := &corev1.EnvVarSource{
 		SecretKeyRef: &corev1.SecretKeySelector{
-			LocalObjectReference: corev1.LocalObjectReference{Name: b.mysqlAuthName},
-			Key:                  "username",
+			LocalObjectReference: corev1.LocalObjectReference{Name: database.authSecret},
+			Key:                  mysqlUsernameKey,
 		},
 	}
 
 	passwordSecret := &corev1.EnvVarSource{
 		SecretKeyRef: &corev1.SecretKeySelector{
-			LocalObjectReference: corev1.LocalObjectReference{Name: b.mysqlAuthName},
-			Key:                  "password",
+			LocalObjectReference: corev1.LocalObjectReference{Name: database.authSecret},
+			Key:                  mysqlPasswordKey,
 		},
 	}
 
@@ -114,7 +117,7 @@ func (b *backendEnsurer) backendDeployment(v *appv1alpha1.VisitorsApp, scheme *r
 			Namespace: v.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &size,
+			Replicas: tierReplicas(v.Spec.Backend.TierSpec, v.Spec.Size),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
@@ -124,21 +127,26 @@ func (b *backendEnsurer) backendDeployment(v *appv1alpha1.VisitorsApp, scheme *r
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{{
-						Image:           b.image,
+						Image:           tierImage(v.Spec.Backend.TierSpec, b.image),
 						ImagePullPolicy: corev1.PullNever,
 						Name:            "visitors-service",
 						Ports: []corev1.ContainerPort{{
 							ContainerPort: int32(b.port),
 							Name:          "visitors",
+							Protocol:      corev1.ProtocolTCP,
 						}},
 						Env: []corev1.EnvVar{
 							{
 								Name:  "MYSQL_DATABASE",
-								Value: "visitors",
+								Value: database.name,
 							},
 							{
 								Name:  "MYSQL_SERVICE_HOST",
-								Value: b.mysqlServiceName,
+								Value: database.host,
+							},
+							{
+								Name:  "MYSQL_SERVICE_PORT",
+								Value: strconv.Itoa(int(database.port)),
 							},
 							{
 								Name:      "MYSQL_USERNAME",
@@ -155,29 +163,15 @@ func (b *backendEnsurer) backendDeployment(v *appv1alpha1.VisitorsApp, scheme *r
 		},
 	}
 
+	applyTierSpec(&dep.Spec.Template.Spec, v.Spec.Backend.TierSpec)
+	setCredentialsHash(&dep.Spec.Template, credentialsHash)
+
 	controllerutil.SetControllerReference(v, dep, scheme)
 	return dep
 }
 
-func (b *backendEnsurer) backendService(v *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
-	labels := labels(v, "backend")
-
-	s := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      v.Name + b.servicePostfix,
-			Namespace: v.Namespace,
-		},
-		Spec: corev1.ServiceSpec{
-			Selector: labels,
-			Ports: []corev1.ServicePort{{
-				Protocol:   corev1.ProtocolTCP,
-				Port:       int32(b.port),
-				TargetPort: intstr.FromInt(b.port),
-				NodePort:   30685,
-			}},
-			Type: corev1.ServiceTypeNodePort,
-		},
-	}
+func (b *backendEnsurer) backendService(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
+	s := tierService(v, v.Name+b.servicePostfix, "backend", b.port, v.Spec.Backend.Service)
 
 	controllerutil.SetControllerReference(v, s, scheme)
 	return s
@@ -185,22 +179,22 @@ func (b *backendEnsurer) backendService(v *appv1alpha1.VisitorsApp, scheme *runt
 
 func NewBackendEnsurer(
 	cli client.Client,
+	recorder record.EventRecorder,
 	port int,
-	servicePort int,
 	image string,
-	mysqlAuthName string,
-	mysqlServiceName string,
+	mysqlAuthPostfix string,
+	mysqlServicePostfix string,
 	deploymentPostfix string,
 	servicePostfix string,
 ) WorkloadEnsurer {
 	return &backendEnsurer{
-		client:            cli,
-		port:              port,
-		servicePort:       servicePort,
-		image:             image,
-		mysqlAuthName:     mysqlAuthName,
-		mysqlServiceName:  mysqlServiceName,
-		deploymentPostfix: deploymentPostfix,
-		servicePostfix:    servicePostfix,
+		client:              cli,
+		recorder:            recorder,
+		port:                port,
+		image:               image,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		deploymentPostfix:   deploymentPostfix,
+		servicePostfix:      servicePostfix,
 	}
 }
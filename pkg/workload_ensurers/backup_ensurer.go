@@ -0,0 +1,289 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const backupVolumeName = "backup"
+
+// backupScript dumps the visitors database to the backup volume, prunes the
+// dumps of the app beyond the retention count and reports the file name and
+// size of the new dump through the termination message of the container. The
+// dumps are prefixed with the app name followed by an underscore, which object
+// names can't hold, so the dumps of another app sharing the volume are left
+// alone.
+const backupScript = `set -eo pipefail
+file="${BACKUP_PREFIX}_$(date -u +%Y%m%d%H%M%S).sql.gz"
+mysqldump --single-transaction --no-tablespaces \
+  -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u "$MYSQL_USER" "$MYSQL_DATABASE" \
+  | gzip > "/backup/$file.tmp"
+mv "/backup/$file.tmp" "/backup/$file"
+ls -1t "/backup/${BACKUP_PREFIX}"_*.sql.gz | tail -n +$((RETENTION + 1)) | xargs -r rm -f
+echo "$file $(stat -c %s "/backup/$file")" > /dev/termination-log
+`
+
+type backupEnsurer struct {
+	client              client.Client
+	apiReader           client.Reader
+	recorder            record.EventRecorder
+	image               string
+	cronJobPostfix      string
+	mysqlServicePostfix string
+	mysqlAuthPostfix    string
+}
+
+// EnsureDeployment ensures the backup CronJob, or deletes it once backups
+// are no longer configured
+func (b *backupEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if instance.Spec.Backup == nil {
+		cronJob := &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + b.cronJobPostfix,
+			Namespace: instance.Namespace,
+		}}
+		if err := deleteOwnedObject(ctx, instance, cronJob, b.client, b.recorder); err != nil {
+			return &reconcile.Result{}, err
+		}
+		return nil, nil
+	}
+
+	return applyObject(ctx, instance, b.backupCronJob(instance, scheme), b.client, b.recorder)
+}
+
+func (b *backupEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (b *backupEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (b *backupEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return true
+}
+
+// UpdateStatus records the last successful backup job on the instance
+func (b *backupEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	if instance.Spec.Backup == nil {
+		return nil
+	}
+
+	jobs := &batchv1.JobList{}
+	err := b.client.List(ctx, jobs,
+		client.InNamespace(instance.Namespace),
+		client.MatchingLabels(labels(instance, "backup")),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Finished jobs are pruned by the CronJob, so keep what was recorded
+	// when there's nothing newer to report
+	var completed []*batchv1.Job
+	lastBackup := instance.Status.LastBackup
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Status.Succeeded == 0 || job.Status.CompletionTime == nil {
+			continue
+		}
+		if lastBackup != nil && !job.Status.CompletionTime.After(lastBackup.CompletionTime.Time) {
+			continue
+		}
+		completed = append(completed, job)
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].Status.CompletionTime.After(completed[j].Status.CompletionTime.Time)
+	})
+
+	// The pod of a job may have been garbage collected, its dump can't be
+	// told then and an older job is reported instead
+	for _, job := range completed {
+		backup, err := b.backupFromJob(ctx, job)
+		if err != nil {
+			return err
+		}
+		if backup == nil {
+			continue
+		}
+		instance.Status.LastBackup = backup
+		b.recorder.Eventf(instance, corev1.EventTypeNormal, "BackupCompleted",
+			"Backed up the database to %s (%s)", backup.File, backup.Size.String())
+		return nil
+	}
+	return nil
+}
+
+// backupFromJob reads the dump reported by the pod of a succeeded backup job.
+// The manager doesn't cache pods, so they are read from the API server. It
+// returns nil when the pod is gone.
+func (b *backupEnsurer) backupFromJob(ctx context.Context, job *batchv1.Job) (*appv1beta1.BackupStatus, error) {
+	pods := &corev1.PodList{}
+	err := b.apiReader.List(ctx, pods,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{"job-name": job.Name},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pods.Items) == 0 {
+		return nil, nil
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			if container.State.Terminated == nil {
+				continue
+			}
+			fields := strings.Fields(container.State.Terminated.Message)
+			if len(fields) != 2 {
+				continue
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("backup job %q reported an invalid size: %w", job.Name, err)
+			}
+			return &appv1beta1.BackupStatus{
+				CompletionTime: *job.Status.CompletionTime,
+				Size:           *resource.NewQuantity(size, resource.BinarySI),
+				File:           fields[0],
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("backup job %q didn't report its dump", job.Name)
+}
+
+func (b *backupEnsurer) backupCronJob(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *batchv1.CronJob {
+	labels := labels(v, "backup")
+	backup := v.Spec.Backup
+	database := visitorsDatabase(v, b.mysqlServicePostfix, b.mysqlAuthPostfix)
+
+	successfulJobsHistoryLimit := int32(3)
+	failedJobsHistoryLimit := int32(1)
+	backoffLimit := int32(2)
+
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + b.cronJobPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   backup.Schedule,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &successfulJobsHistoryLimit,
+			FailedJobsHistoryLimit:     &failedJobsHistoryLimit,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labels,
+						},
+						Spec: backupPodSpec(v, tierImage(v.Spec.Database.MySQL.TierSpec, b.image), database),
+					},
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, cronJob, scheme)
+	return cronJob
+}
+
+// backupPodSpec returns the pod running backupScript against the database,
+// writing to spec.backup.targetPVC
+func backupPodSpec(v *appv1beta1.VisitorsApp, image string, database databaseEndpoint) corev1.PodSpec {
+	backup := v.Spec.Backup
+
+	retention := backup.Retention
+	if retention < 1 {
+		retention = appv1beta1.DefaultBackupRetention
+	}
+
+	return corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		Containers: []corev1.Container{{
+			Image:   image,
+			Name:    "visitors-backup",
+			Command: []string{"bash", "-c", backupScript},
+			Env: append(databaseClientEnv(database),
+				corev1.EnvVar{
+					Name:  "BACKUP_PREFIX",
+					Value: v.Name,
+				},
+				corev1.EnvVar{
+					Name:  "RETENTION",
+					Value: strconv.Itoa(int(retention)),
+				},
+			),
+			VolumeMounts: []corev1.VolumeMount{{
+				Name:      backupVolumeName,
+				MountPath: "/backup",
+			}},
+		}},
+		Volumes: []corev1.Volume{{
+			Name: backupVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: backup.TargetPVC,
+				},
+			},
+		}},
+	}
+}
+
+func NewBackupEnsurer(
+	cli client.Client,
+	apiReader client.Reader,
+	recorder record.EventRecorder,
+	image string,
+	cronJobPostfix string,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) WorkloadEnsurer {
+	return &backupEnsurer{
+		client:              cli,
+		apiReader:           apiReader,
+		recorder:            recorder,
+		image:               image,
+		cronJobPostfix:      cronJobPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+	}
+}
@@ -0,0 +1,110 @@
+package workload_ensurers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newTestBackupJob returns a backup job of the app that succeeded at the given
+// time and, unless file is empty, its pod reporting the dump
+func newTestBackupJob(v *appv1beta1.VisitorsApp, name string, completion time.Time, file string) []client.Object {
+	completionTime := metav1.NewTime(completion)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: v.Namespace, Labels: labels(v, "backup")},
+		Status:     batchv1.JobStatus{Succeeded: 1, CompletionTime: &completionTime},
+	}
+	if file == "" {
+		return []client.Object{job}
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-pod",
+			Namespace: v.Namespace,
+			Labels:    map[string]string{"job-name": name},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodSucceeded,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{Message: file + " 1024\n"},
+				},
+			}},
+		},
+	}
+	return []client.Object{job, pod}
+}
+
+// The last backup is read from the newest job whose pod is still around, and
+// kept when none is newer
+func TestBackupStatusSkipsJobsWithoutPod(t *testing.T) {
+	ctx := context.Background()
+	recorded := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	older := recorded.Add(time.Hour)
+	newer := recorded.Add(2 * time.Hour)
+
+	tests := []struct {
+		name string
+		jobs [][]client.Object
+		want string
+	}{
+		{
+			name: "newest job reported",
+			jobs: [][]client.Object{
+				newTestBackupJob(newTestApp(), "older", older, "app_older.sql.gz"),
+				newTestBackupJob(newTestApp(), "newer", newer, "app_newer.sql.gz"),
+			},
+			want: "app_newer.sql.gz",
+		},
+		{
+			name: "pod of the newest job gone",
+			jobs: [][]client.Object{
+				newTestBackupJob(newTestApp(), "older", older, "app_older.sql.gz"),
+				newTestBackupJob(newTestApp(), "newer", newer, ""),
+			},
+			want: "app_older.sql.gz",
+		},
+		{
+			name: "every pod gone",
+			jobs: [][]client.Object{
+				newTestBackupJob(newTestApp(), "older", older, ""),
+				newTestBackupJob(newTestApp(), "newer", newer, ""),
+			},
+			want: "app_recorded.sql.gz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := newTestApp()
+			instance.Spec.Backup = &appv1beta1.BackupSpec{Schedule: "@daily", TargetPVC: "backups"}
+			instance.Status.LastBackup = &appv1beta1.BackupStatus{
+				CompletionTime: metav1.NewTime(recorded),
+				Size:           resource.MustParse("1Ki"),
+				File:           "app_recorded.sql.gz",
+			}
+			objs := []client.Object{instance}
+			for _, job := range tt.jobs {
+				objs = append(objs, job...)
+			}
+			cli := newTestClient(t, objs...)
+			backup := NewBackupEnsurer(cli, cli, newTestRecorder(), appv1beta1.DefaultMySQLImage,
+				"-mysql-backup", "-mysql-service", "-mysql-auth")
+
+			if err := backup.UpdateStatus(ctx, instance); err != nil {
+				t.Fatalf("updating the status: %v", err)
+			}
+			if got := instance.Status.LastBackup.File; got != tt.want {
+				t.Errorf("last backup = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
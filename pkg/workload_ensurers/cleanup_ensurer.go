@@ -0,0 +1,261 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// cleanupEnsurer carries out the deletion policy of an instance being deleted.
+// The MySQL data volume claims aren't owned by the instance, so they outlive it
+// unless they are deleted here.
+type cleanupEnsurer struct {
+	client              client.Client
+	recorder            record.EventRecorder
+	image               string
+	jobPostfix          string
+	mysqlServicePostfix string
+	mysqlAuthPostfix    string
+}
+
+// EnsureDeployment takes the final snapshot when asked for, then deletes the
+// data volume claims unless they are retained
+func (c *cleanupEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	policy := deletionPolicy(instance)
+
+	if policy == appv1beta1.DeletionPolicySnapshot {
+		if instance.Spec.Backup == nil {
+			err := fmt.Errorf("the Snapshot deletion policy needs spec.backup.targetPVC")
+			instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+				"SnapshotFailed", err.Error())
+			return &reconcile.Result{}, err
+		}
+		result, err := c.ensureSnapshot(ctx, instance, scheme)
+		if result != nil {
+			return result, err
+		}
+	}
+
+	if policy == appv1beta1.DeletionPolicyRetain {
+		return nil, nil
+	}
+
+	err := c.deleteDataClaims(ctx, instance)
+	if err != nil {
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"DeleteVolumesFailed", err.Error())
+		c.recorder.Event(instance, corev1.EventTypeWarning, reasonDeleteFailed, err.Error())
+		return &reconcile.Result{}, err
+	}
+	return nil, nil
+}
+
+func (c *cleanupEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+// EnsureSecret releases the generated credentials secret from the instance
+// when the data is retained, so that it isn't garbage collected along with it
+func (c *cleanupEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if deletionPolicy(instance) != appv1beta1.DeletionPolicyRetain ||
+		instance.Spec.Database.External != nil ||
+		instance.Spec.Database.MySQL.CredentialsSecret != "" {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := c.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + c.mysqlAuthPostfix,
+		Namespace: instance.Namespace,
+	}, secret)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"RetainSecretFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	if !metav1.IsControlledBy(secret, instance) {
+		return nil, nil
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	var ownerReferences []metav1.OwnerReference
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID != instance.UID {
+			ownerReferences = append(ownerReferences, ref)
+		}
+	}
+	secret.OwnerReferences = ownerReferences
+	logf.FromContext(ctx).Info("Retaining the credentials secret", "kind", "Secret", "object", secret.Name)
+	err = c.client.Patch(ctx, secret, patch)
+	if err != nil {
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"RetainSecretFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	c.recorder.Eventf(instance, corev1.EventTypeNormal, "Retained",
+		"Released Secret %s so it outlives the app", secret.Name)
+	return nil, nil
+}
+
+func (c *cleanupEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return true
+}
+
+// UpdateStatus records that the deletion policy has been carried out
+func (c *cleanupEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	policy := deletionPolicy(instance)
+	instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionTrue,
+		string(policy)+"Complete", "The "+string(policy)+" deletion policy has been carried out")
+	return nil
+}
+
+// ensureSnapshot runs the final dump job and returns a non-nil result until it
+// has succeeded. A failed job leaves the instance in place, either delete the
+// job to retry or change the deletion policy.
+func (c *cleanupEnsurer) ensureSnapshot(
+	ctx context.Context,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	job := &batchv1.Job{}
+	err := c.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + c.jobPostfix,
+		Namespace: instance.Namespace,
+	}, job)
+	if err != nil && errors.IsNotFound(err) {
+		logf.FromContext(ctx).Info("Creating the snapshot Job", "kind", "Job", "object", instance.Name+c.jobPostfix)
+		err = c.client.Create(ctx, c.snapshotJob(instance, scheme))
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		c.recorder.Eventf(instance, corev1.EventTypeNormal, "SnapshotStarted",
+			"Dumping the database to PersistentVolumeClaim %s", instance.Spec.Backup.TargetPVC)
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"SnapshotInProgress", "Dumping the database to "+instance.Spec.Backup.TargetPVC)
+		// The job completion triggers the next reconcile
+		return &reconcile.Result{}, nil
+	} else if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	if jobFailed(job) {
+		err = fmt.Errorf("snapshot job %q failed, delete it to retry", job.Name)
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"SnapshotFailed", err.Error())
+		c.recorder.Event(instance, corev1.EventTypeWarning, "SnapshotFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	if job.Status.Succeeded == 0 {
+		instance.SetCondition(appv1beta1.ConditionCleanedUp, metav1.ConditionFalse,
+			"SnapshotInProgress", "Dumping the database to "+instance.Spec.Backup.TargetPVC)
+		return &reconcile.Result{}, nil
+	}
+	return nil, nil
+}
+
+// deleteDataClaims deletes the MySQL data volume claims. They are only gone
+// once the statefulset pods using them are, after the instance itself.
+func (c *cleanupEnsurer) deleteDataClaims(ctx context.Context, v *appv1beta1.VisitorsApp) error {
+	claims := &corev1.PersistentVolumeClaimList{}
+	err := c.client.List(ctx, claims,
+		client.InNamespace(v.Namespace),
+		client.MatchingLabels(labels(v, "mysql")),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range claims.Items {
+		logf.FromContext(ctx).Info("Deleting volume claim", "kind", "PersistentVolumeClaim", "object", claims.Items[i].Name)
+		err = c.client.Delete(ctx, &claims.Items[i])
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.recorder.Eventf(v, corev1.EventTypeNormal, reasonDeleted,
+			"Deleted PersistentVolumeClaim %s", claims.Items[i].Name)
+	}
+	return nil
+}
+
+func (c *cleanupEnsurer) snapshotJob(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *batchv1.Job {
+	labels := labels(v, "snapshot")
+	database := visitorsDatabase(v, c.mysqlServicePostfix, c.mysqlAuthPostfix)
+	backoffLimit := int32(2)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + c.jobPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: backupPodSpec(v, tierImage(v.Spec.Database.MySQL.TierSpec, c.image), database),
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, job, scheme)
+	return job
+}
+
+// deletionPolicy returns the deletion policy of the instance, Delete when unset
+func deletionPolicy(v *appv1beta1.VisitorsApp) appv1beta1.DeletionPolicy {
+	if v.Spec.DeletionPolicy == "" {
+		return appv1beta1.DeletionPolicyDelete
+	}
+	return v.Spec.DeletionPolicy
+}
+
+func NewCleanupEnsurer(
+	cli client.Client,
+	recorder record.EventRecorder,
+	image string,
+	jobPostfix string,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) WorkloadEnsurer {
+	return &cleanupEnsurer{
+		client:              cli,
+		recorder:            recorder,
+		image:               image,
+		jobPostfix:          jobPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+	}
+}
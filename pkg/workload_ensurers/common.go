@@ -2,119 +2,507 @@ package workload_ensurers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"strconv"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// fieldManager is the server-side apply field manager of the operator
+const fieldManager = "visitorsapp-operator"
+
+// Keys of the MySQL credentials secret
+const (
+	mysqlRootPasswordKey = "root-password"
+	mysqlUsernameKey     = "username"
+	mysqlPasswordKey     = "password"
+)
+
+// credentialsHashAnnotation holds the hash of the credentials secret on the
+// pod template, so that changing the secret rolls the pods
+const credentialsHashAnnotation = "app.my.domain/credentials-hash"
+
+// Reasons of the events recorded on the instance
+const (
+	reasonCreated        = "Created"
+	reasonUpdated        = "Updated"
+	reasonScaled         = "Scaled"
+	reasonDriftCorrected = "DriftCorrected"
+	reasonDeleted        = "Deleted"
+	reasonApplyFailed    = "ApplyFailed"
+	reasonDeleteFailed   = "DeleteFailed"
+)
+
 func ensureDeployment(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	dep *appsv1.Deployment,
 	cli client.Client,
+	recorder record.EventRecorder,
 ) (*reconcile.Result, error) {
+	return applyObject(ctx, instance, dep, cli, recorder)
+}
 
-	// See if deployment already exists and create if it doesn't
-	found := &appsv1.Deployment{}
-	err := cli.Get(context.TODO(), types.NamespacedName{
-		Name:      dep.Name,
-		Namespace: instance.Namespace,
-	}, found)
-	if err != nil && errors.IsNotFound(err) {
+func ensureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	s *corev1.Service,
+	cli client.Client,
+	recorder record.EventRecorder,
+) (*reconcile.Result, error) {
+	return applyObject(ctx, instance, s, cli, recorder)
+}
 
-		// Create the deployment
-		//log.Info("Creating a new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
-		err = cli.Create(context.TODO(), dep)
+func ensureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	s *corev1.Secret,
+	cli client.Client,
+	recorder record.EventRecorder,
+) (*reconcile.Result, error) {
+	return applyObject(ctx, instance, s, cli, recorder)
+}
 
-		if err != nil {
-			// Deployment failed
-			//log.Error(err, "Failed to create new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
-			return &reconcile.Result{}, err
-		} else {
-			// Deployment was successful
-			return nil, nil
-		}
-	} else if err != nil {
-		// Error that isn't due to the deployment not existing
-		//log.Error(err, "Failed to get Deployment")
+func ensureStatefulSet(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	sts *appsv1.StatefulSet,
+	cli client.Client,
+	recorder record.EventRecorder,
+) (*reconcile.Result, error) {
+	found := &appsv1.StatefulSet{}
+	err := cli.Get(ctx, client.ObjectKeyFromObject(sts), found)
+	if err != nil && !errors.IsNotFound(err) {
+		// Error that isn't due to the statefulset not existing
+		logf.FromContext(ctx).Error(err, "Failed to get StatefulSet", "object", sts.Name)
 		return &reconcile.Result{}, err
 	}
+	if err == nil {
+		// Volume claim templates can't be changed once the StatefulSet exists,
+		// so keep the live ones
+		sts.Spec.VolumeClaimTemplates = found.Spec.VolumeClaimTemplates
+	}
 
-	return nil, nil
+	return applyObject(ctx, instance, sts, cli, recorder)
 }
 
-func ensureService(
-	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
-	s *corev1.Service,
+// deleteOwnedObject deletes the object if it exists and is controlled by the instance
+func deleteOwnedObject(
+	ctx context.Context,
+	instance *appv1beta1.VisitorsApp,
+	obj client.Object,
 	cli client.Client,
-) (*reconcile.Result, error) {
-	found := &corev1.Service{}
-	err := cli.Get(context.TODO(), types.NamespacedName{
-		Name:      s.Name,
-		Namespace: instance.Namespace,
-	}, found)
-	if err != nil && errors.IsNotFound(err) {
+	recorder record.EventRecorder,
+) error {
+	err := cli.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+	if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		// Objects of a kind that isn't installed don't exist either
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-		// Create the service
-		//log.Info("Creating a new Service", "Service.Namespace", s.Namespace, "Service.Name", s.Name)
-		err = cli.Create(context.TODO(), s)
+	if !metav1.IsControlledBy(obj, instance) {
+		return nil
+	}
 
-		if err != nil {
-			// Creation failed
-			//log.Error(err, "Failed to create new Service", "Service.Namespace", s.Namespace, "Service.Name", s.Name)
-			return &reconcile.Result{}, err
-		} else {
-			// Creation was successful
-			return nil, nil
-		}
+	kind := objectKind(obj, cli)
+	logger := logf.FromContext(ctx).WithValues("kind", kind, "object", obj.GetName())
+	logger.Info("Deleting object")
+	err = cli.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if errors.IsNotFound(err) {
+		return nil
 	} else if err != nil {
-		// Error that isn't due to the service not existing
-		//log.Error(err, "Failed to get Service")
-		return &reconcile.Result{}, err
+		logger.Error(err, "Failed to delete object")
+		recorder.Eventf(instance, corev1.EventTypeWarning, reasonDeleteFailed,
+			"Failed to delete %s %s: %v", kind, obj.GetName(), err)
+		return err
 	}
-
-	return nil, nil
+	recorder.Eventf(instance, corev1.EventTypeNormal, reasonDeleted, "Deleted %s %s", kind, obj.GetName())
+	return nil
 }
 
-func ensureSecret(request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
-	s *corev1.Secret,
+// applyObject reconciles the live object to the desired one with a
+// server-side apply, creating it if it doesn't exist yet. Fields set on the
+// desired object are owned by the operator, so manual edits to them are
+// reverted on the next reconcile. Every change made is recorded as an event
+// on the instance.
+func applyObject(
+	ctx context.Context,
+	instance *appv1beta1.VisitorsApp,
+	obj client.Object,
 	cli client.Client,
+	recorder record.EventRecorder,
 ) (*reconcile.Result, error) {
-	found := &corev1.Secret{}
-	err := cli.Get(context.TODO(), types.NamespacedName{
-		Name:      s.Name,
-		Namespace: instance.Namespace,
-	}, found)
-	if err != nil && errors.IsNotFound(err) {
-		// Create the secret
-		//log.Info("Creating a new secret", "Secret.Namespace", s.Namespace, "Secret.Name", s.Name)
-		err = cli.Create(context.TODO(), s)
+	gvk, err := apiutil.GVKForObject(obj, cli.Scheme())
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	logger := logf.FromContext(ctx).WithValues("kind", gvk.Kind, "object", obj.GetName())
 
+	// Keep the live object around to tell what the apply changed. Kinds
+	// outside of the scheme are handled as unstructured objects.
+	var liveObj client.Object
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		liveObj = u
+	} else {
+		live, err := cli.Scheme().New(gvk)
 		if err != nil {
-			// Creation failed
-			//log.Error(err, "Failed to create new Secret", "Secret.Namespace", s.Namespace, "Secret.Name", s.Name)
 			return &reconcile.Result{}, err
-		} else {
-			// Creation was successful
-			return nil, nil
 		}
-	} else if err != nil {
-		// Error that isn't due to the secret not existing
-		//log.Error(err, "Failed to get Secret")
+		liveObj = live.(client.Object)
+	}
+	err = cli.Get(ctx, client.ObjectKeyFromObject(obj), liveObj)
+	if err != nil && !errors.IsNotFound(err) {
 		return &reconcile.Result{}, err
 	}
+	exists := err == nil
+
+	// Apply patches are sent as is, so they must carry their type
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+	err = cli.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	if err != nil {
+		logger.Error(err, "Failed to apply object")
+		recorder.Eventf(instance, corev1.EventTypeWarning, reasonApplyFailed,
+			"Failed to apply %s %s: %v", gvk.Kind, obj.GetName(), err)
+		return &reconcile.Result{}, err
+	}
+
+	switch {
+	case !exists:
+		logger.Info("Created object")
+		recorder.Eventf(instance, corev1.EventTypeNormal, reasonCreated, "Created %s %s", gvk.Kind, obj.GetName())
+	case liveObj.GetResourceVersion() == obj.GetResourceVersion():
+		// Nothing changed
+		logger.V(1).Info("Object is up to date")
+	case rolledOut(instance):
+		// The spec was fully rolled out already, so the live object must
+		// have been changed behind the operator's back
+		logger.Info("Reverted drift of object")
+		recorder.Eventf(instance, corev1.EventTypeNormal, reasonDriftCorrected,
+			"Reverted changes made to %s %s outside of the operator", gvk.Kind, obj.GetName())
+	default:
+		from, to, scaled := replicasChange(liveObj, obj)
+		if scaled {
+			logger.Info("Scaled object", "from", from, "to", to)
+			recorder.Eventf(instance, corev1.EventTypeNormal, reasonScaled,
+				"Scaled %s %s from %d to %d replicas", gvk.Kind, obj.GetName(), from, to)
+		} else {
+			logger.Info("Updated object")
+			recorder.Eventf(instance, corev1.EventTypeNormal, reasonUpdated, "Updated %s %s", gvk.Kind, obj.GetName())
+		}
+	}
 
 	return nil, nil
 }
 
-func labels(v *appv1alpha1.VisitorsApp, tier string) map[string]string {
+// rolledOut returns whether the last reconcile rolled out the current
+// generation of the instance completely
+func rolledOut(instance *appv1beta1.VisitorsApp) bool {
+	progressing := meta.FindStatusCondition(instance.Status.Conditions, appv1beta1.ConditionProgressing)
+	return progressing != nil &&
+		progressing.Status == metav1.ConditionFalse &&
+		progressing.Reason == "RolloutComplete" &&
+		progressing.ObservedGeneration == instance.Generation
+}
+
+// replicasChange returns the replica counts of a deployment or statefulset
+// before and after an update, and whether they differ
+func replicasChange(before client.Object, after client.Object) (int32, int32, bool) {
+	var from, to *int32
+	switch after := after.(type) {
+	case *appsv1.Deployment:
+		from, to = before.(*appsv1.Deployment).Spec.Replicas, after.Spec.Replicas
+	case *appsv1.StatefulSet:
+		from, to = before.(*appsv1.StatefulSet).Spec.Replicas, after.Spec.Replicas
+	default:
+		return 0, 0, false
+	}
+	if from == nil || to == nil || *from == *to {
+		return 0, 0, false
+	}
+	return *from, *to, true
+}
+
+// objectKind returns the kind of the object for event messages
+func objectKind(obj client.Object, cli client.Client) string {
+	gvk, err := apiutil.GVKForObject(obj, cli.Scheme())
+	if err != nil {
+		return "object"
+	}
+	return gvk.Kind
+}
+
+const (
+	mysqlPort            = 3306
+	visitorsDatabaseName = "visitors"
+)
+
+// databaseEndpoint describes how the backend reaches the visitors database
+type databaseEndpoint struct {
+	host       string
+	port       int32
+	name       string
+	authSecret string
+}
+
+// visitorsDatabase returns the endpoint of the visitors database of the
+// instance: the external one when configured, the in-cluster MySQL otherwise
+func visitorsDatabase(
+	v *appv1beta1.VisitorsApp,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) databaseEndpoint {
+	if v.Spec.Database.External != nil {
+		return externalDatabase(v.Spec.Database.External)
+	}
+	return databaseEndpoint{
+		host:       v.Name + mysqlServicePostfix,
+		port:       mysqlPort,
+		name:       visitorsDatabaseName,
+		authSecret: mysqlAuthSecretName(v, mysqlAuthPostfix),
+	}
+}
+
+func externalDatabase(external *appv1beta1.ExternalDatabaseSpec) databaseEndpoint {
+	database := databaseEndpoint{
+		host:       external.Host,
+		port:       external.Port,
+		name:       external.DatabaseName,
+		authSecret: external.CredentialsSecret,
+	}
+	if database.port == 0 {
+		database.port = appv1beta1.DefaultDatabasePort
+	}
+	if database.name == "" {
+		database.name = appv1beta1.DefaultDatabaseName
+	}
+	return database
+}
+
+// databaseClientEnv returns the environment the mysql command line clients
+// need to connect to the database
+func databaseClientEnv(database databaseEndpoint) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name:  "MYSQL_HOST",
+			Value: database.host,
+		},
+		{
+			Name:  "MYSQL_PORT",
+			Value: strconv.Itoa(int(database.port)),
+		},
+		{
+			Name:  "MYSQL_DATABASE",
+			Value: database.name,
+		},
+		{
+			Name: "MYSQL_USER",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: database.authSecret},
+					Key:                  mysqlUsernameKey,
+				},
+			},
+		},
+		{
+			Name: "MYSQL_PWD",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: database.authSecret},
+					Key:                  mysqlPasswordKey,
+				},
+			},
+		},
+	}
+}
+
+// mysqlAuthSecretName returns the name of the secret holding the MySQL
+// credentials: the one referenced by the instance, or the operator managed one
+func mysqlAuthSecretName(v *appv1beta1.VisitorsApp, authPostfix string) string {
+	if v.Spec.Database.MySQL.CredentialsSecret != "" {
+		return v.Spec.Database.MySQL.CredentialsSecret
+	}
+	return v.Name + authPostfix
+}
+
+// secretHash returns a hash of the contents of the named secret, empty when
+// the secret doesn't exist yet
+func secretHash(ctx context.Context, cli client.Client, name string, namespace string) (string, error) {
+	secret := &corev1.Secret{}
+	err := cli.Get(ctx, types.NamespacedName{
+		Name:      name,
+		Namespace: namespace,
+	}, secret)
+	if errors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write(secret.Data[key])
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// setCredentialsHash records the hash of the credentials secret on the pod
+// template
+func setCredentialsHash(template *corev1.PodTemplateSpec, hash string) {
+	if hash == "" {
+		return
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[credentialsHashAnnotation] = hash
+}
+
+// randomPassword returns a random alphanumeric password of the given length
+func randomPassword(length int) (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// deploymentAvailable returns whether the named deployment has all of its
+// desired replicas available
+func deploymentAvailable(ctx context.Context, cli client.Client, name string, namespace string) bool {
+	deployment := &appsv1.Deployment{}
+	err := cli.Get(ctx, types.NamespacedName{
+		Name:      name,
+		Namespace: namespace,
+	}, deployment)
+	if err != nil {
+		return false
+	}
+
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	return deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.AvailableReplicas >= desired
+}
+
+// tierService builds the Service in front of a tier as configured by the
+// instance. The cluster allocates the node port unless one is asked for.
+func tierService(
+	v *appv1beta1.VisitorsApp,
+	name string,
+	tier string,
+	targetPort int,
+	spec appv1beta1.ServiceSpec,
+) *corev1.Service {
+	serviceType := spec.Type
+	if serviceType == "" {
+		serviceType = appv1beta1.DefaultServiceType
+	}
+
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   v.Namespace,
+			Annotations: spec.Annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels(v, tier),
+			Ports: []corev1.ServicePort{{
+				Protocol:   corev1.ProtocolTCP,
+				Port:       servicePort(spec, targetPort),
+				TargetPort: intstr.FromInt(targetPort),
+			}},
+			Type: serviceType,
+		},
+	}
+	if serviceType != corev1.ServiceTypeClusterIP {
+		s.Spec.Ports[0].NodePort = spec.NodePort
+	}
+	return s
+}
+
+// servicePort returns the port the Service of a tier listens on
+func servicePort(spec appv1beta1.ServiceSpec, targetPort int) int32 {
+	if spec.Port == 0 {
+		return int32(targetPort)
+	}
+	return spec.Port
+}
+
+// tierImage returns the image configured for the tier or the given default
+func tierImage(tier appv1beta1.TierSpec, defaultImage string) string {
+	if tier.Image != "" {
+		return tier.Image
+	}
+	return defaultImage
+}
+
+// tierReplicas returns the replica count configured for the tier or the given default
+func tierReplicas(tier appv1beta1.TierSpec, defaultReplicas int32) *int32 {
+	if tier.Replicas != nil {
+		replicas := *tier.Replicas
+		return &replicas
+	}
+	return &defaultReplicas
+}
+
+// applyTierSpec copies the container and scheduling settings of the tier onto
+// the pod spec. The tier container is expected to be the first one.
+func applyTierSpec(podSpec *corev1.PodSpec, tier appv1beta1.TierSpec) {
+	container := &podSpec.Containers[0]
+	container.Resources = *tier.Resources.DeepCopy()
+	for _, env := range tier.Env {
+		container.Env = append(container.Env, *env.DeepCopy())
+	}
+
+	podSpec.NodeSelector = tier.NodeSelector
+	podSpec.Tolerations = tier.Tolerations
+	podSpec.Affinity = tier.Affinity.DeepCopy()
+}
+
+func labels(v *appv1beta1.VisitorsApp, tier string) map[string]string {
 	return map[string]string{
 		"app":             "visitors",
 		"visitorssite_cr": v.Name,
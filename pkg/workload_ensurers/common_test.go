@@ -0,0 +1,122 @@
+package workload_ensurers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// applyClient stands in for server-side apply, which the fake client doesn't
+// support, with a create or a merge patch of the whole object
+type applyClient struct {
+	client.Client
+}
+
+func (c applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	err := c.Client.Create(ctx, obj)
+	if errors.IsAlreadyExists(err) {
+		return c.Client.Patch(ctx, obj, client.Merge)
+	}
+	return err
+}
+
+func newTestClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(appv1beta1.AddToScheme(scheme))
+	return applyClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func newTestRecorder() record.EventRecorder {
+	// Events aren't looked at, the buffer only has to outlast the test
+	return record.NewFakeRecorder(1000)
+}
+
+func newTestApp() *appv1beta1.VisitorsApp {
+	return &appv1beta1.VisitorsApp{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "app",
+			Namespace:         "default",
+			UID:               "app-uid",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+		},
+	}
+}
+
+func newTestRequest(v *appv1beta1.VisitorsApp) reconcile.Request {
+	return reconcile.Request{NamespacedName: types.NamespacedName{Name: v.Name, Namespace: v.Namespace}}
+}
+
+func TestTierService(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     appv1beta1.ServiceSpec
+		want     corev1.ServicePort
+		wantType corev1.ServiceType
+	}{
+		{
+			name:     "defaults",
+			want:     corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 8000, TargetPort: intstr.FromInt(8000)},
+			wantType: corev1.ServiceTypeNodePort,
+		},
+		{
+			name: "overrides",
+			spec: appv1beta1.ServiceSpec{
+				Type:        corev1.ServiceTypeLoadBalancer,
+				Port:        80,
+				NodePort:    30080,
+				Annotations: map[string]string{"service.beta.kubernetes.io/aws-load-balancer-internal": "true"},
+			},
+			want:     corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(8000), NodePort: 30080},
+			wantType: corev1.ServiceTypeLoadBalancer,
+		},
+		{
+			name:     "no node port on a cluster IP",
+			spec:     appv1beta1.ServiceSpec{Type: corev1.ServiceTypeClusterIP, NodePort: 30080},
+			want:     corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 8000, TargetPort: intstr.FromInt(8000)},
+			wantType: corev1.ServiceTypeClusterIP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestApp()
+			s := tierService(v, "app-backend-service", "backend", 8000, tt.spec)
+
+			if s.Name != "app-backend-service" || s.Namespace != v.Namespace {
+				t.Errorf("service = %s/%s, want %s/app-backend-service", s.Namespace, s.Name, v.Namespace)
+			}
+			if s.Spec.Type != tt.wantType {
+				t.Errorf("type = %s, want %s", s.Spec.Type, tt.wantType)
+			}
+			if len(s.Spec.Ports) != 1 || !reflect.DeepEqual(s.Spec.Ports[0], tt.want) {
+				t.Errorf("ports = %+v, want [%+v]", s.Spec.Ports, tt.want)
+			}
+			if !reflect.DeepEqual(s.Annotations, tt.spec.Annotations) {
+				t.Errorf("annotations = %v, want %v", s.Annotations, tt.spec.Annotations)
+			}
+			if !reflect.DeepEqual(s.Spec.Selector, labels(v, "backend")) {
+				t.Errorf("selector = %v, want %v", s.Spec.Selector, labels(v, "backend"))
+			}
+		})
+	}
+}
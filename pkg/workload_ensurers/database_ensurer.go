@@ -0,0 +1,66 @@
+package workload_ensurers
+
+import (
+	"context"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// databaseEnsurer is the ensurer of the database tier. It hands every call to
+// the in-cluster MySQL ensurer, or to the one checking the external database
+// when the instance is configured with one.
+type databaseEnsurer struct {
+	mysql    WorkloadEnsurer
+	external WorkloadEnsurer
+}
+
+func (d *databaseEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return d.ensurer(instance).EnsureDeployment(ctx, request, instance, scheme)
+}
+
+func (d *databaseEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return d.ensurer(instance).EnsureService(ctx, request, instance, scheme)
+}
+
+func (d *databaseEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return d.ensurer(instance).EnsureSecret(ctx, request, instance, scheme)
+}
+
+func (d *databaseEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return d.ensurer(instance).CheckWorkload(ctx, instance)
+}
+
+func (d *databaseEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	return d.ensurer(instance).UpdateStatus(ctx, instance)
+}
+
+func (d *databaseEnsurer) ensurer(instance *appv1beta1.VisitorsApp) WorkloadEnsurer {
+	if instance.Spec.Database.External != nil {
+		return d.external
+	}
+	return d.mysql
+}
+
+func NewDatabaseEnsurer(mysql WorkloadEnsurer, external WorkloadEnsurer) WorkloadEnsurer {
+	return &databaseEnsurer{
+		mysql:    mysql,
+		external: external,
+	}
+}
@@ -1,108 +1,102 @@
 package workload_ensurers
 
 import (
+	"context"
 	"time"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
-type ensureWorkloadDirector struct {
-	ensurer WorkloadEnsurer
-}
-
-func (e *ensureWorkloadDirector) SetEnsurer(ensurer WorkloadEnsurer) {
-	e.ensurer = ensurer
-}
-
-func (e *ensureWorkloadDirector) EnsureMysql(
-	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
-	scheme *runtime.Scheme,
-) (*reconcile.Result, error) {
-	result, err := e.ensurer.EnsureSecret(request, instance, scheme)
-	if result != nil {
-		return result, err
-	}
-
-	result, err = e.ensurer.EnsureDeployment(request, instance, scheme)
-	if result != nil {
-		return result, err
-	}
-
-	result, err = e.ensurer.EnsureService(request, instance, scheme)
-	if result != nil {
-		return result, err
-	}
-
-	mysqlRunning := e.ensurer.CheckWorkload(instance)
-
-	if !mysqlRunning {
-		// If MySQL isn't running yet, requeue the reconcile
-		// to run again after a delay
-		delay := time.Second * time.Duration(5)
-
-		// log.Info(fmt.Sprintf("MySQL isn't running, waiting for %s", delay))
-		return &reconcile.Result{RequeueAfter: delay}, nil
-	}
-	return nil, nil
-}
-
-func (e *ensureWorkloadDirector) EnsureBackend(
+// notReadyDelay is how long to wait before checking again on a tier that
+// isn't ready. Not every tier's progress triggers a reconcile, e.g. an
+// external database coming up.
+const notReadyDelay = 5 * time.Second
+
+// ensureWorkloadDirector runs the steps of each tier against the ensurer it
+// is given. It holds no state, so concurrent reconciles can share it.
+type ensureWorkloadDirector struct{}
+
+// EnsureTier runs the steps of a tier: the secret, the workload and its
+// service, then the status, and finally checks the workload. A non-nil result
+// means the tier isn't ready and the tiers depending on it must wait. The
+// ready condition, when the tier has one, follows the progress of the steps.
+func (e *ensureWorkloadDirector) EnsureTier(
+	ctx context.Context,
+	ensurer WorkloadEnsurer,
+	name string,
+	readyCondition string,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	result, err := e.ensurer.EnsureDeployment(request, instance, scheme)
-	if result != nil {
-		return result, err
+	ctx = withTier(ctx, name)
+	steps := []struct {
+		name   string
+		ensure func(context.Context, reconcile.Request, *appv1beta1.VisitorsApp, *runtime.Scheme) (*reconcile.Result, error)
+	}{
+		{"Secret", ensurer.EnsureSecret},
+		{"Deployment", ensurer.EnsureDeployment},
+		{"Service", ensurer.EnsureService},
 	}
-
-	result, err = e.ensurer.EnsureService(request, instance, scheme)
-	if result != nil {
-		return result, err
+	for _, step := range steps {
+		result, err := step.ensure(ctx, request, instance, scheme)
+		if result != nil {
+			setStepCondition(instance, readyCondition, step.name, err)
+			return result, err
+		}
 	}
 
-	err = e.ensurer.UpdateStatus(instance)
+	err := ensurer.UpdateStatus(ctx, instance)
 	if err != nil {
+		setStepCondition(instance, readyCondition, "Status", err)
 		// Requeue the request if the status could not be updated
 		return &reconcile.Result{}, err
 	}
 
-	result, err = e.ensurer.HandleWorkloadChanges(instance)
-	if result != nil {
-		return result, err
+	ready := ensurer.CheckWorkload(ctx, instance)
+	setReadyCondition(instance, readyCondition, name, ready)
+	if !ready {
+		logf.FromContext(ctx).Info("Tier isn't ready yet, requeueing", "after", notReadyDelay)
+		return &reconcile.Result{RequeueAfter: notReadyDelay}, nil
 	}
 	return nil, nil
 }
 
-func (e *ensureWorkloadDirector) EnsureFrontend(
-	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
-	scheme *runtime.Scheme,
-) (*reconcile.Result, error) {
-	result, err := e.ensurer.EnsureDeployment(request, instance, scheme)
-	if result != nil {
-		return result, err
-	}
-
-	result, err = e.ensurer.EnsureService(request, instance, scheme)
-	if result != nil {
-		return result, err
+// setStepCondition marks the tier condition false because the given step
+// either failed or asked for the reconcile to be requeued. Tiers without a
+// condition are left alone.
+func setStepCondition(instance *appv1beta1.VisitorsApp, conditionType string, step string, err error) {
+	if conditionType == "" {
+		return
 	}
-
-	err = e.ensurer.UpdateStatus(instance)
 	if err != nil {
-		// Requeue the request
-		return &reconcile.Result{}, err
+		instance.SetCondition(conditionType, metav1.ConditionFalse, step+"Failed", err.Error())
+		return
 	}
+	instance.SetCondition(conditionType, metav1.ConditionFalse, step+"InProgress",
+		"Waiting for the "+step+" step to complete")
+}
 
-	result, err = e.ensurer.HandleWorkloadChanges(instance)
-	if result != nil {
-		return result, err
+func setReadyCondition(instance *appv1beta1.VisitorsApp, conditionType string, tier string, ready bool) {
+	if conditionType == "" {
+		return
 	}
-	return nil, nil
+	if ready {
+		instance.SetCondition(conditionType, metav1.ConditionTrue,
+			"Ready", "The "+tier+" tier is ready")
+		return
+	}
+	instance.SetCondition(conditionType, metav1.ConditionFalse,
+		"WaitingForReplicas", "Waiting for the "+tier+" tier to become ready")
+}
+
+// withTier adds the tier being ensured to the logger of the reconcile
+func withTier(ctx context.Context, tier string) context.Context {
+	return logf.IntoContext(ctx, logf.FromContext(ctx).WithValues("tier", tier))
 }
 
 func NewEnsureWorkloadDirector() EnsureWorkloadDirector {
@@ -0,0 +1,117 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// externalDatabaseDialTimeout bounds the connectivity check of the external database
+const externalDatabaseDialTimeout = 3 * time.Second
+
+// externalDatabaseEnsurer stands in for the MySQL tier when the instance uses
+// a database managed outside of the cluster: it creates nothing and only
+// checks that the database can be reached.
+type externalDatabaseEnsurer struct {
+	client   client.Client
+	recorder record.EventRecorder
+}
+
+func (e *externalDatabaseEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (e *externalDatabaseEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+// EnsureSecret checks that the credentials secret of the external database
+// holds the keys the backend reads
+func (e *externalDatabaseEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	name := instance.Spec.Database.External.CredentialsSecret
+
+	secret := &corev1.Secret{}
+	err := e.client.Get(ctx, types.NamespacedName{
+		Name:      name,
+		Namespace: instance.Namespace,
+	}, secret)
+	if err != nil {
+		return &reconcile.Result{}, fmt.Errorf("credentials secret %q: %w", name, err)
+	}
+
+	for _, key := range []string{mysqlUsernameKey, mysqlPasswordKey} {
+		if len(secret.Data[key]) == 0 {
+			return &reconcile.Result{}, fmt.Errorf("credentials secret %q has no %q key", name, key)
+		}
+	}
+	return nil, nil
+}
+
+// CheckWorkload returns whether the external database accepts TCP connections
+// and records the outcome of the check in the instance conditions
+func (e *externalDatabaseEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	database := externalDatabase(instance.Spec.Database.External)
+	address := net.JoinHostPort(database.host, strconv.Itoa(int(database.port)))
+
+	// Only changes of reachability are worth an event
+	wasReachable := meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionExternalDatabaseReachable)
+	wasUnreachable := meta.IsStatusConditionFalse(instance.Status.Conditions, appv1beta1.ConditionExternalDatabaseReachable)
+
+	dialer := net.Dialer{Timeout: externalDatabaseDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		instance.SetCondition(appv1beta1.ConditionExternalDatabaseReachable, metav1.ConditionFalse,
+			"ConnectionFailed", err.Error())
+		if !wasUnreachable {
+			e.recorder.Eventf(instance, corev1.EventTypeWarning, "DatabaseUnreachable",
+				"Can't connect to %s: %v", address, err)
+		}
+		return false
+	}
+	conn.Close()
+
+	instance.SetCondition(appv1beta1.ConditionExternalDatabaseReachable, metav1.ConditionTrue,
+		"Connected", "Connected to "+address)
+	if !wasReachable {
+		e.recorder.Event(instance, corev1.EventTypeNormal, "DatabaseReachable", "Connected to "+address)
+	}
+	return true
+}
+
+func (e *externalDatabaseEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	return nil
+}
+
+func NewExternalDatabaseEnsurer(cli client.Client, recorder record.EventRecorder) WorkloadEnsurer {
+	return &externalDatabaseEnsurer{
+		client:   cli,
+		recorder: recorder,
+	}
+}
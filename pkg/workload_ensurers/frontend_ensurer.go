@@ -2,15 +2,13 @@ package workload_ensurers
 
 import (
 	"context"
-	"time"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -18,87 +16,61 @@ import (
 
 type frontendEnsurer struct {
 	client            client.Client
+	recorder          record.EventRecorder
 	port              int
-	servicePort       int
 	image             string
 	deploymentPostfix string
 	servicePostfix    string
 }
 
 func (f *frontendEnsurer) EnsureDeployment(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureDeployment(request, instance, f.frontendDeployment(instance, scheme), f.client)
+	return ensureDeployment(ctx, request, instance, f.frontendDeployment(instance, scheme), f.client, f.recorder)
 }
 
 func (f *frontendEnsurer) EnsureService(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureService(request, instance, f.frontendService(instance, scheme), f.client)
+	return ensureService(ctx, request, instance, f.frontendService(instance, scheme), f.client, f.recorder)
 }
 
 func (f *frontendEnsurer) EnsureSecret(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
 	return nil, nil
 }
 
-func (f *frontendEnsurer) CheckWorkload(instance *appv1alpha1.VisitorsApp) bool {
-	return true
+// CheckWorkload returns whether all frontend replicas are available
+func (f *frontendEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return deploymentAvailable(ctx, f.client, instance.Name+f.deploymentPostfix, instance.Namespace)
 }
 
-func (f *frontendEnsurer) UpdateStatus(instance *appv1alpha1.VisitorsApp) error {
-	instance.Status.FrontendImage = f.image
-	err := f.client.Status().Update(context.TODO(), instance)
-	return err
+// UpdateStatus records the frontend image on the instance. The status itself
+// is written by the controller once the reconcile is over.
+func (f *frontendEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	instance.Status.FrontendImage = tierImage(instance.Spec.Frontend.TierSpec, f.image)
+	return nil
 }
 
-func (f *frontendEnsurer) HandleWorkloadChanges(
-	instance *appv1alpha1.VisitorsApp,
-) (*reconcile.Result, error) {
-	found := &appsv1.Deployment{}
-	err := f.client.Get(context.TODO(), types.NamespacedName{
-		Name:      instance.Name + f.deploymentPostfix,
-		Namespace: instance.Namespace,
-	}, found)
-	if err != nil {
-		// The deployment may not have been created yet, so requeue
-		return &reconcile.Result{RequeueAfter: 5 * time.Second}, err
-	}
-
-	title := instance.Spec.Title
-	existing := (*found).Spec.Template.Spec.Containers[0].Env[0].Value
-
-	if title != existing {
-		(*found).Spec.Template.Spec.Containers[0].Env[0].Value = title
-		err = f.client.Update(context.TODO(), found)
-		if err != nil {
-			//log.Error(err, "Failed to update Deployment.", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
-			return &reconcile.Result{}, err
-		}
-		// Spec updated - return and requeue
-		return &reconcile.Result{Requeue: true}, nil
-	}
-
-	return nil, nil
-}
-
-func (f *frontendEnsurer) frontendDeployment(instance *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *appsv1.Deployment {
+func (f *frontendEnsurer) frontendDeployment(instance *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *appsv1.Deployment {
 	labels := labels(instance, "frontend")
-	size := int32(1)
 
 	// If the header was specified, add it as an env variable
 	env := []corev1.EnvVar{}
-	if instance.Spec.Title != "" {
+	if instance.Spec.Frontend.Title != "" {
 		env = append(env, corev1.EnvVar{
 			Name:  "REACT_APP_TITLE",
-			Value: instance.Spec.Title,
+			Value: instance.Spec.Frontend.Title,
 		})
 	}
 
@@ -108,7 +80,7 @@ func (f *frontendEnsurer) frontendDeployment(instance *appv1alpha1.VisitorsApp,
 			Namespace: instance.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &size,
+			Replicas: tierReplicas(instance.Spec.Frontend.TierSpec, appv1beta1.DefaultFrontendReplicas),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
@@ -118,11 +90,12 @@ func (f *frontendEnsurer) frontendDeployment(instance *appv1alpha1.VisitorsApp,
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{{
-						Image: f.image,
+						Image: tierImage(instance.Spec.Frontend.TierSpec, f.image),
 						Name:  "visitors-webui",
 						Ports: []corev1.ContainerPort{{
 							ContainerPort: int32(f.port),
 							Name:          "visitors",
+							Protocol:      corev1.ProtocolTCP,
 						}},
 						Env: env,
 					}},
@@ -131,31 +104,14 @@ func (f *frontendEnsurer) frontendDeployment(instance *appv1alpha1.VisitorsApp,
 		},
 	}
 
+	applyTierSpec(&dep.Spec.Template.Spec, instance.Spec.Frontend.TierSpec)
+
 	controllerutil.SetControllerReference(instance, dep, scheme)
 	return dep
 }
 
-func (f *frontendEnsurer) frontendService(instance *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
-	labels := labels(instance, "frontend")
-
-	s := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name + f.servicePostfix,
-			Namespace: instance.Namespace,
-		},
-		Spec: corev1.ServiceSpec{
-			Selector: labels,
-			Ports: []corev1.ServicePort{{
-				Protocol:   corev1.ProtocolTCP,
-				Port:       int32(f.port),
-				TargetPort: intstr.FromInt(f.port),
-				NodePort:   int32(f.servicePort),
-			}},
-			Type: corev1.ServiceTypeNodePort,
-		},
-	}
-
-	//log.Info("Service Spec", "Service.Name", s.ObjectMeta.Name)
+func (f *frontendEnsurer) frontendService(instance *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
+	s := tierService(instance, instance.Name+f.servicePostfix, "frontend", f.port, instance.Spec.Frontend.Service)
 
 	controllerutil.SetControllerReference(instance, s, scheme)
 	return s
@@ -163,16 +119,16 @@ func (f *frontendEnsurer) frontendService(instance *appv1alpha1.VisitorsApp, sch
 
 func NewFrontendEnsurer(
 	cli client.Client,
+	recorder record.EventRecorder,
 	port int,
-	servicePort int,
 	image string,
 	deploymentPostfix string,
 	servicePostfix string,
 ) WorkloadEnsurer {
 	return &frontendEnsurer{
 		client:            cli,
+		recorder:          recorder,
 		port:              port,
-		servicePort:       servicePort,
 		image:             image,
 		deploymentPostfix: deploymentPostfix,
 		servicePostfix:    servicePostfix,
@@ -0,0 +1,251 @@
+package workload_ensurers
+
+import (
+	"context"
+	"path"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// HTTPRouteGVK is the Gateway API HTTPRoute. The Gateway API isn't a
+// dependency of the operator, so routes are handled as unstructured objects.
+var HTTPRouteGVK = schema.GroupVersionKind{
+	Group:   "gateway.networking.k8s.io",
+	Version: "v1",
+	Kind:    "HTTPRoute",
+}
+
+// ingressEnsurer exposes the frontend and backend Services under the host
+// name of spec.ingress
+type ingressEnsurer struct {
+	client                 client.Client
+	recorder               record.EventRecorder
+	backendPort            int
+	frontendPort           int
+	backendServicePostfix  string
+	frontendServicePostfix string
+	postfix                string
+}
+
+// EnsureDeployment ensures the Ingress, or deletes it once spec.ingress is unset
+func (i *ingressEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if instance.Spec.Ingress == nil {
+		ingress := &networkingv1.Ingress{ObjectMeta: i.objectMeta(instance)}
+		if err := deleteOwnedObject(ctx, instance, ingress, i.client, i.recorder); err != nil {
+			return &reconcile.Result{}, err
+		}
+		return nil, nil
+	}
+	return applyObject(ctx, instance, i.ingress(instance, scheme), i.client, i.recorder)
+}
+
+// EnsureService ensures the HTTPRoute when a Gateway is referenced, or
+// deletes it otherwise
+func (i *ingressEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if instance.Spec.Ingress == nil || instance.Spec.Ingress.Gateway == nil {
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(HTTPRouteGVK)
+		route.SetName(instance.Name + i.postfix)
+		route.SetNamespace(instance.Namespace)
+		if err := deleteOwnedObject(ctx, instance, route, i.client, i.recorder); err != nil {
+			return &reconcile.Result{}, err
+		}
+		return nil, nil
+	}
+	return applyObject(ctx, instance, i.httpRoute(instance, scheme), i.client, i.recorder)
+}
+
+func (i *ingressEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (i *ingressEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return true
+}
+
+// UpdateStatus publishes the URL of the web UI on the instance
+func (i *ingressEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	ingress := instance.Spec.Ingress
+	if ingress == nil {
+		instance.Status.URL = ""
+		return nil
+	}
+
+	scheme := "http"
+	if ingress.TLSSecret != "" {
+		scheme = "https"
+	}
+	instance.Status.URL = scheme + "://" + ingress.Host + frontendPath(ingress)
+	return nil
+}
+
+func (i *ingressEnsurer) ingress(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *networkingv1.Ingress {
+	spec := v.Spec.Ingress
+	pathType := networkingv1.PathTypePrefix
+
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: i.objectMeta(v),
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: spec.IngressClassName,
+			Rules: []networkingv1.IngressRule{{
+				Host: spec.Host,
+				IngressRuleValue: networkingv1.IngressRuleValue{
+					HTTP: &networkingv1.HTTPIngressRuleValue{
+						// The longest matching prefix wins, so the API
+						// isn't shadowed by the web UI
+						Paths: []networkingv1.HTTPIngressPath{
+							{
+								Path:     apiPath(spec),
+								PathType: &pathType,
+								Backend: ingressBackend(v.Name+i.backendServicePostfix,
+									servicePort(v.Spec.Backend.Service, i.backendPort)),
+							},
+							{
+								Path:     frontendPath(spec),
+								PathType: &pathType,
+								Backend: ingressBackend(v.Name+i.frontendServicePostfix,
+									servicePort(v.Spec.Frontend.Service, i.frontendPort)),
+							},
+						},
+					},
+				},
+			}},
+		},
+	}
+	if spec.TLSSecret != "" {
+		ingress.Spec.TLS = []networkingv1.IngressTLS{{
+			Hosts:      []string{spec.Host},
+			SecretName: spec.TLSSecret,
+		}}
+	}
+
+	controllerutil.SetControllerReference(v, ingress, scheme)
+	return ingress
+}
+
+func (i *ingressEnsurer) httpRoute(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *unstructured.Unstructured {
+	spec := v.Spec.Ingress
+
+	parentRef := map[string]interface{}{
+		"name": spec.Gateway.Name,
+	}
+	if spec.Gateway.Namespace != "" {
+		parentRef["namespace"] = spec.Gateway.Namespace
+	}
+	if spec.Gateway.SectionName != "" {
+		parentRef["sectionName"] = spec.Gateway.SectionName
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{parentRef},
+			"hostnames":  []interface{}{spec.Host},
+			"rules": []interface{}{
+				httpRouteRule(apiPath(spec), v.Name+i.backendServicePostfix,
+					servicePort(v.Spec.Backend.Service, i.backendPort)),
+				httpRouteRule(frontendPath(spec), v.Name+i.frontendServicePostfix,
+					servicePort(v.Spec.Frontend.Service, i.frontendPort)),
+			},
+		},
+	}}
+	route.SetGroupVersionKind(HTTPRouteGVK)
+	route.SetName(v.Name + i.postfix)
+	route.SetNamespace(v.Namespace)
+	route.SetLabels(labels(v, "ingress"))
+
+	controllerutil.SetControllerReference(v, route, scheme)
+	return route
+}
+
+func (i *ingressEnsurer) objectMeta(v *appv1beta1.VisitorsApp) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      v.Name + i.postfix,
+		Namespace: v.Namespace,
+		Labels:    labels(v, "ingress"),
+	}
+}
+
+func ingressBackend(service string, port int32) networkingv1.IngressBackend {
+	return networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: service,
+			Port: networkingv1.ServiceBackendPort{Number: port},
+		},
+	}
+}
+
+func httpRouteRule(pathPrefix string, service string, port int32) interface{} {
+	return map[string]interface{}{
+		"matches": []interface{}{
+			map[string]interface{}{
+				"path": map[string]interface{}{
+					"type":  "PathPrefix",
+					"value": pathPrefix,
+				},
+			},
+		},
+		"backendRefs": []interface{}{
+			map[string]interface{}{
+				"name": service,
+				"port": int64(port),
+			},
+		},
+	}
+}
+
+// frontendPath returns the path the web UI is served under
+func frontendPath(spec *appv1beta1.IngressSpec) string {
+	if spec.Path == "" {
+		return appv1beta1.DefaultIngressPath
+	}
+	return spec.Path
+}
+
+// apiPath returns the path the API is served under, below the web UI one
+func apiPath(spec *appv1beta1.IngressSpec) string {
+	return path.Join(frontendPath(spec), "api")
+}
+
+func NewIngressEnsurer(
+	cli client.Client,
+	recorder record.EventRecorder,
+	backendPort int,
+	frontendPort int,
+	backendServicePostfix string,
+	frontendServicePostfix string,
+	postfix string,
+) WorkloadEnsurer {
+	return &ingressEnsurer{
+		client:                 cli,
+		recorder:               recorder,
+		backendPort:            backendPort,
+		frontendPort:           frontendPort,
+		backendServicePostfix:  backendServicePostfix,
+		frontendServicePostfix: frontendServicePostfix,
+		postfix:                postfix,
+	}
+}
@@ -0,0 +1,169 @@
+package workload_ensurers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newTestIngressEnsurer() *ingressEnsurer {
+	return NewIngressEnsurer(nil, newTestRecorder(), 8000, 3000,
+		"-backend-service", "-frontend-service", "-ingress").(*ingressEnsurer)
+}
+
+func TestIngress(t *testing.T) {
+	className := "nginx"
+	tests := []struct {
+		name    string
+		ingress appv1beta1.IngressSpec
+		backend appv1beta1.ServiceSpec
+		paths   []networkingv1.HTTPIngressPath
+		wantTLS []networkingv1.IngressTLS
+	}{
+		{
+			name:    "defaults",
+			ingress: appv1beta1.IngressSpec{Host: "visitors.example.com"},
+			paths: []networkingv1.HTTPIngressPath{
+				{Path: "/api", Backend: ingressBackend("app-backend-service", 8000)},
+				{Path: "/", Backend: ingressBackend("app-frontend-service", 3000)},
+			},
+		},
+		{
+			name: "path, service port and TLS",
+			ingress: appv1beta1.IngressSpec{
+				Host:             "visitors.example.com",
+				Path:             "/visitors",
+				TLSSecret:        "visitors-tls",
+				IngressClassName: &className,
+			},
+			backend: appv1beta1.ServiceSpec{Port: 80},
+			paths: []networkingv1.HTTPIngressPath{
+				{Path: "/visitors/api", Backend: ingressBackend("app-backend-service", 80)},
+				{Path: "/visitors", Backend: ingressBackend("app-frontend-service", 3000)},
+			},
+			wantTLS: []networkingv1.IngressTLS{{Hosts: []string{"visitors.example.com"}, SecretName: "visitors-tls"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestApp()
+			v.Spec.Ingress = &tt.ingress
+			v.Spec.Backend.Service = tt.backend
+			ingress := newTestIngressEnsurer().ingress(v, newTestClient(t).Scheme())
+
+			if ingress.Name != "app-ingress" || ingress.Namespace != v.Namespace {
+				t.Errorf("ingress = %s/%s, want %s/app-ingress", ingress.Namespace, ingress.Name, v.Namespace)
+			}
+			if !reflect.DeepEqual(ingress.Spec.IngressClassName, tt.ingress.IngressClassName) {
+				t.Errorf("ingress class = %v, want %v", ingress.Spec.IngressClassName, tt.ingress.IngressClassName)
+			}
+			if !reflect.DeepEqual(ingress.Spec.TLS, tt.wantTLS) {
+				t.Errorf("TLS = %+v, want %+v", ingress.Spec.TLS, tt.wantTLS)
+			}
+			if len(ingress.Spec.Rules) != 1 || ingress.Spec.Rules[0].Host != tt.ingress.Host {
+				t.Fatalf("rules = %+v, want one for %s", ingress.Spec.Rules, tt.ingress.Host)
+			}
+
+			paths := ingress.Spec.Rules[0].HTTP.Paths
+			if len(paths) != len(tt.paths) {
+				t.Fatalf("paths = %+v, want %+v", paths, tt.paths)
+			}
+			for n, path := range paths {
+				if path.PathType == nil || *path.PathType != networkingv1.PathTypePrefix {
+					t.Errorf("path %s has type %v, want %s", path.Path, path.PathType, networkingv1.PathTypePrefix)
+				}
+				path.PathType = nil
+				if !reflect.DeepEqual(path, tt.paths[n]) {
+					t.Errorf("path %d = %+v, want %+v", n, path, tt.paths[n])
+				}
+			}
+			if len(ingress.OwnerReferences) != 1 || ingress.OwnerReferences[0].UID != v.UID {
+				t.Errorf("owner references = %+v, want the app", ingress.OwnerReferences)
+			}
+		})
+	}
+}
+
+func TestHTTPRoute(t *testing.T) {
+	v := newTestApp()
+	v.Spec.Ingress = &appv1beta1.IngressSpec{
+		Host: "visitors.example.com",
+		Path: "/visitors",
+		Gateway: &appv1beta1.GatewayReference{
+			Name:        "gateway",
+			Namespace:   "infra",
+			SectionName: "https",
+		},
+	}
+	v.Spec.Frontend.Service = appv1beta1.ServiceSpec{Port: 80}
+	route := newTestIngressEnsurer().httpRoute(v, newTestClient(t).Scheme())
+
+	if route.GroupVersionKind() != HTTPRouteGVK {
+		t.Errorf("kind = %s, want %s", route.GroupVersionKind(), HTTPRouteGVK)
+	}
+	if route.GetName() != "app-ingress" || route.GetNamespace() != v.Namespace {
+		t.Errorf("route = %s/%s, want %s/app-ingress", route.GetNamespace(), route.GetName(), v.Namespace)
+	}
+	if len(route.GetOwnerReferences()) != 1 || route.GetOwnerReferences()[0].UID != v.UID {
+		t.Errorf("owner references = %+v, want the app", route.GetOwnerReferences())
+	}
+
+	want := map[string]interface{}{
+		"parentRefs": []interface{}{
+			map[string]interface{}{"name": "gateway", "namespace": "infra", "sectionName": "https"},
+		},
+		"hostnames": []interface{}{"visitors.example.com"},
+		"rules": []interface{}{
+			httpRouteRule("/visitors/api", "app-backend-service", 8000),
+			httpRouteRule("/visitors", "app-frontend-service", 80),
+		},
+	}
+	spec, _, _ := unstructured.NestedMap(route.Object, "spec")
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("spec = %v, want %v", spec, want)
+	}
+}
+
+func TestIngressURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress *appv1beta1.IngressSpec
+		want    string
+	}{
+		{
+			name: "no ingress",
+			want: "",
+		},
+		{
+			name:    "http",
+			ingress: &appv1beta1.IngressSpec{Host: "visitors.example.com"},
+			want:    "http://visitors.example.com/",
+		},
+		{
+			name:    "https under a path",
+			ingress: &appv1beta1.IngressSpec{Host: "visitors.example.com", Path: "/visitors", TLSSecret: "visitors-tls"},
+			want:    "https://visitors.example.com/visitors",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestApp()
+			v.Spec.Ingress = tt.ingress
+			// A URL published earlier is replaced or cleared
+			v.Status.URL = "http://stale.example.com/"
+
+			if err := newTestIngressEnsurer().UpdateStatus(context.Background(), v); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v.Status.URL != tt.want {
+				t.Errorf("URL = %q, want %q", v.Status.URL, tt.want)
+			}
+		})
+	}
+}
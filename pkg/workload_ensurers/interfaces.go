@@ -1,49 +1,62 @@
 package workload_ensurers
 
 import (
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	"context"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 type EnsureWorkloadDirector = interface {
-	SetEnsurer(ensurer WorkloadEnsurer)
-	EnsureMysql(
-		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
-		scheme *runtime.Scheme,
-	) (*reconcile.Result, error)
-	EnsureBackend(
-		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
-		scheme *runtime.Scheme,
-	) (*reconcile.Result, error)
-	EnsureFrontend(
+	EnsureTier(
+		ctx context.Context,
+		ensurer WorkloadEnsurer,
+		name string,
+		readyCondition string,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 }
 
 type WorkloadEnsurer = interface {
 	EnsureDeployment(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 	EnsureService(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
 	EnsureSecret(
+		ctx context.Context,
 		request reconcile.Request,
-		instance *appv1alpha1.VisitorsApp,
+		instance *appv1beta1.VisitorsApp,
 		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
-	UpdateStatus(instance *appv1alpha1.VisitorsApp) error
-	HandleWorkloadChanges(
-		instance *appv1alpha1.VisitorsApp,
+	UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error
+	CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool
+}
+
+// Tier is a step of the reconcile, ensured once the tiers it depends on are ready
+type Tier = interface {
+	Name() string
+	DependsOn() []string
+	ReadyCondition() string
+	Ensure(
+		ctx context.Context,
+		request reconcile.Request,
+		instance *appv1beta1.VisitorsApp,
+		scheme *runtime.Scheme,
 	) (*reconcile.Result, error)
-	CheckWorkload(instance *appv1alpha1.VisitorsApp) bool
+}
+
+// TierPipeline holds the tiers of the app in dependency order
+type TierPipeline = interface {
+	Tiers() []Tier
 }
@@ -2,176 +2,457 @@ package workload_ensurers
 
 import (
 	"context"
+	"fmt"
 
-	appv1alpha1 "example.com/m/v2/pkg/api/v1alpha1"
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+const mysqlDataVolumeName = "data"
+
+// mysqlReadinessCommand checks that the server answers over TCP, which it
+// only does once the data directory is initialized. The ping succeeds even
+// when access is denied, so it doesn't depend on passwords the container only
+// read at start and that may have been rotated since.
+var mysqlReadinessCommand = []string{"mysqladmin", "ping", "-h", "127.0.0.1", "--silent"}
+
 type mysqlEnsurer struct {
-	client         client.Client
-	deploymentName string
-	serviceName    string
-	authName       string
+	client            client.Client
+	recorder          record.EventRecorder
+	deploymentPostfix string
+	servicePostfix    string
+	authPostfix       string
+	migrationPostfix  string
+	image             string
 }
 
+// EnsureDeployment ensures the MySQL workload: a StatefulSet when persistent
+// storage is configured and a Deployment otherwise. A workload of the other
+// kind, left from an earlier mode, is deleted first since both select the same
+// pods, a Deployment only once its data has been migrated. So is the workload
+// left under the legacy name.
 func (m *mysqlEnsurer) EnsureDeployment(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureDeployment(request, instance, m.mysqlDeployment(instance, scheme), m.client)
+	key := metav1.ObjectMeta{Name: instance.Name + m.deploymentPostfix, Namespace: instance.Namespace}
+
+	migrated, err := m.migrateLegacy(ctx, instance, scheme)
+	if err != nil || !migrated {
+		return &reconcile.Result{}, err
+	}
+
+	if instance.Spec.Database.MySQL.Storage == nil {
+		err := deleteOwnedObject(ctx, instance, &appsv1.StatefulSet{ObjectMeta: key}, m.client, m.recorder)
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		return ensureDeployment(ctx, request, instance, m.mysqlDeployment(instance, scheme), m.client, m.recorder)
+	}
+
+	migrated, err = m.migrateDeployment(ctx, instance, scheme)
+	if err != nil || !migrated {
+		return &reconcile.Result{}, err
+	}
+
+	err = m.expandDataClaims(ctx, instance)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	return ensureStatefulSet(ctx, request, instance, m.mysqlStatefulSet(instance, scheme), m.client, m.recorder)
 }
 
 func (m *mysqlEnsurer) EnsureService(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureService(request, instance, m.mysqlService(instance, scheme), m.client)
+	return ensureService(ctx, request, instance, m.mysqlService(instance, scheme), m.client, m.recorder)
 }
 
+// EnsureSecret ensures the generated MySQL credentials secret, or checks the
+// secret referenced by the instance when the user brings their own.
 func (m *mysqlEnsurer) EnsureSecret(
+	ctx context.Context,
 	request reconcile.Request,
-	instance *appv1alpha1.VisitorsApp,
+	instance *appv1beta1.VisitorsApp,
 	scheme *runtime.Scheme,
 ) (*reconcile.Result, error) {
-	return ensureSecret(request, instance, m.mysqlAuthSecret(instance, scheme), m.client)
-}
+	if instance.Spec.Database.MySQL.CredentialsSecret != "" {
+		err := m.checkCredentialsSecret(ctx, instance)
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		return nil, nil
+	}
 
-// CheckWorkload returns whether the MySQL deployment is running
-func (m *mysqlEnsurer) CheckWorkload(v *appv1alpha1.VisitorsApp) bool {
-	deployment := &appsv1.Deployment{}
+	secret, err := m.mysqlAuthSecret(ctx, instance, scheme)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	return ensureSecret(ctx, request, instance, secret, m.client, m.recorder)
+}
 
-	err := m.client.Get(context.TODO(), types.NamespacedName{
-		Name:      m.deploymentName,
+// CheckWorkload returns whether every desired replica of the MySQL deployment
+// or statefulset is ready
+func (m *mysqlEnsurer) CheckWorkload(ctx context.Context, v *appv1beta1.VisitorsApp) bool {
+	key := types.NamespacedName{
+		Name:      v.Name + m.deploymentPostfix,
 		Namespace: v.Namespace,
-	}, deployment)
-
-	if err != nil {
-		// log.Error(err, "Deployment mysql not found")
-		return false
 	}
 
-	if deployment.Status.ReadyReplicas == 1 {
-		return true
+	var desired *int32
+	var readyReplicas int32
+	if v.Spec.Database.MySQL.Storage != nil {
+		sts := &appsv1.StatefulSet{}
+		if err := m.client.Get(ctx, key, sts); err != nil {
+			logf.FromContext(ctx).Error(err, "Failed to get StatefulSet", "kind", "StatefulSet", "object", key.Name)
+			return false
+		}
+		if sts.Status.ObservedGeneration < sts.Generation {
+			return false
+		}
+		desired, readyReplicas = sts.Spec.Replicas, sts.Status.ReadyReplicas
+	} else {
+		deployment := &appsv1.Deployment{}
+		if err := m.client.Get(ctx, key, deployment); err != nil {
+			logf.FromContext(ctx).Error(err, "Failed to get Deployment", "kind", "Deployment", "object", key.Name)
+			return false
+		}
+		if deployment.Status.ObservedGeneration < deployment.Generation {
+			return false
+		}
+		desired, readyReplicas = deployment.Spec.Replicas, deployment.Status.ReadyReplicas
 	}
 
-	return false
+	if desired == nil {
+		return readyReplicas >= 1
+	}
+	return readyReplicas >= *desired
 }
 
-func (m *mysqlEnsurer) UpdateStatus(instance *appv1alpha1.VisitorsApp) error {
+// UpdateStatus drops the reachability condition left over from an external
+// database the instance was switched away from
+func (m *mysqlEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	meta.RemoveStatusCondition(&instance.Status.Conditions, appv1beta1.ConditionExternalDatabaseReachable)
 	return nil
 }
 
-func (m *mysqlEnsurer) HandleWorkloadChanges(
-	instance *appv1alpha1.VisitorsApp,
-) (*reconcile.Result, error) {
-	return nil, nil
+// checkCredentialsSecret returns an error unless the secret referenced by the
+// instance exists and holds every credential MySQL needs
+func (m *mysqlEnsurer) checkCredentialsSecret(ctx context.Context, v *appv1beta1.VisitorsApp) error {
+	secret := &corev1.Secret{}
+	err := m.client.Get(ctx, types.NamespacedName{
+		Name:      v.Spec.Database.MySQL.CredentialsSecret,
+		Namespace: v.Namespace,
+	}, secret)
+	if err != nil {
+		return fmt.Errorf("credentials secret %q: %w", v.Spec.Database.MySQL.CredentialsSecret, err)
+	}
+
+	for _, key := range []string{mysqlRootPasswordKey, mysqlUsernameKey, mysqlPasswordKey} {
+		if len(secret.Data[key]) == 0 {
+			return fmt.Errorf("credentials secret %q has no %q key", secret.Name, key)
+		}
+	}
+	return nil
 }
 
-func (m *mysqlEnsurer) mysqlAuthSecret(v *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *corev1.Secret {
+// mysqlAuthSecret builds the operator managed credentials secret. Passwords
+// are taken over from the legacy secret or generated on first creation, and
+// then read back from the live secret so they stay stable across reconciles.
+func (m *mysqlEnsurer) mysqlAuthSecret(ctx context.Context, v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) (*corev1.Secret, error) {
+	found := &corev1.Secret{}
+	err := m.client.Get(ctx, types.NamespacedName{
+		Name:      v.Name + m.authPostfix,
+		Namespace: v.Namespace,
+	}, found)
+	if errors.IsNotFound(err) {
+		// Carry over the credentials the legacy database was initialized with
+		found.Data, err = m.legacyAuthData(ctx, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{}
+	for _, key := range []string{mysqlRootPasswordKey, mysqlUsernameKey, mysqlPasswordKey} {
+		if value := found.Data[key]; len(value) > 0 {
+			data[key] = value
+		}
+	}
+
+	if _, ok := data[mysqlUsernameKey]; !ok {
+		data[mysqlUsernameKey] = []byte("visitors-user")
+	}
+	if _, ok := data[mysqlRootPasswordKey]; !ok && found.Data != nil {
+		// Databases set up before the root password was generated were
+		// initialized with this one, record it so the secret tells the truth
+		data[mysqlRootPasswordKey] = []byte("password")
+	}
+	for _, key := range []string{mysqlRootPasswordKey, mysqlPasswordKey} {
+		if _, ok := data[key]; ok {
+			continue
+		}
+		password, err := randomPassword(24)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = []byte(password)
+	}
+
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      m.authName,
+			Name:      v.Name + m.authPostfix,
 			Namespace: v.Namespace,
 		},
-		Type: "Opaque",
-		StringData: map[string]string{
-			"username": "visitors-user",
-			"password": "visitors-pass",
-		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
 	}
 	controllerutil.SetControllerReference(v, secret, scheme)
-	return secret
+	return secret, nil
 }
 
-func (m *mysqlEnsurer) mysqlDeployment(v *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *appsv1.Deployment {
-	labels := labels(v, "mysql")
-	size := v.Spec.Size
+// mysqlPodTemplate builds the MySQL pod template. Unlike the backend, its pods
+// don't roll when the credentials change: MySQL only reads them when it
+// initializes the data directory, and without storage a new pod starts from
+// an empty database. Changes of the passwords are applied by jobs instead.
+func (m *mysqlEnsurer) mysqlPodTemplate(v *appv1beta1.VisitorsApp) corev1.PodTemplateSpec {
+	authName := mysqlAuthSecretName(v, m.authPostfix)
+
+	rootPasswordSecret := &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: authName},
+			Key:                  mysqlRootPasswordKey,
+		},
+	}
 
 	userSecret := &corev1.EnvVarSource{
 		SecretKeyRef: &corev1.SecretKeySelector{
-			LocalObjectReference: corev1.LocalObjectReference{Name: m.authName},
-			Key:                  "username",
+			LocalObjectReference: corev1.LocalObjectReference{Name: authName},
+			Key:                  mysqlUsernameKey,
 		},
 	}
 
 	passwordSecret := &corev1.EnvVarSource{
 		SecretKeyRef: &corev1.SecretKeySelector{
-			LocalObjectReference: corev1.LocalObjectReference{Name: m.authName},
-			Key:                  "password",
+			LocalObjectReference: corev1.LocalObjectReference{Name: authName},
+			Key:                  mysqlPasswordKey,
+		},
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: labels(v, "mysql"),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Image: tierImage(v.Spec.Database.MySQL.TierSpec, m.image),
+				Name:  "visitors-mysql",
+				Ports: []corev1.ContainerPort{{
+					ContainerPort: 3306,
+					Name:          "mysql",
+					Protocol:      corev1.ProtocolTCP,
+				}},
+				Env: []corev1.EnvVar{
+					{
+						Name:      "MYSQL_ROOT_PASSWORD",
+						ValueFrom: rootPasswordSecret,
+					},
+					{
+						Name:  "MYSQL_DATABASE",
+						Value: "visitors",
+					},
+					{
+						Name:      "MYSQL_USER",
+						ValueFrom: userSecret,
+					},
+					{
+						Name:      "MYSQL_PASSWORD",
+						ValueFrom: passwordSecret,
+					},
+				},
+				ReadinessProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{
+							Command: mysqlReadinessCommand,
+						},
+					},
+					InitialDelaySeconds: 5,
+					PeriodSeconds:       5,
+					TimeoutSeconds:      3,
+				},
+				LivenessProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{
+							Command: []string{"mysqladmin", "ping", "-h", "127.0.0.1"},
+						},
+					},
+					// The first start initializes the data directory, which
+					// can take a while on slow volumes
+					InitialDelaySeconds: 60,
+					PeriodSeconds:       10,
+					TimeoutSeconds:      5,
+				},
+			}},
 		},
 	}
 
+	applyTierSpec(&template.Spec, v.Spec.Database.MySQL.TierSpec)
+	return template
+}
+
+func (m *mysqlEnsurer) mysqlDeployment(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *appsv1.Deployment {
+	labels := labels(v, "mysql")
+
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      m.deploymentName,
+			Name:      v.Name + m.deploymentPostfix,
 			Namespace: v.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &size,
+			Replicas: mysqlReplicas(v),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
-			Template: corev1.PodTemplateSpec{
+			Template: m.mysqlPodTemplate(v),
+		},
+	}
+
+	controllerutil.SetControllerReference(v, dep, scheme)
+	return dep
+}
+
+func (m *mysqlEnsurer) mysqlStatefulSet(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *appsv1.StatefulSet {
+	labels := labels(v, "mysql")
+	storage := v.Spec.Database.MySQL.Storage
+
+	template := m.mysqlPodTemplate(v)
+	container := &template.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      mysqlDataVolumeName,
+		MountPath: "/var/lib/mysql",
+		// MySQL refuses to initialize a data directory that isn't empty,
+		// and a fresh filesystem may come with a lost+found directory
+		SubPath: "mysql",
+	}, corev1.VolumeMount{
+		Name:      mysqlDataVolumeName,
+		MountPath: "/docker-entrypoint-initdb.d",
+		SubPath:   mysqlInitSubPath,
+		ReadOnly:  true,
+	})
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + m.deploymentPostfix,
+			Namespace: v.Namespace,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    mysqlReplicas(v),
+			ServiceName: v.Name + m.servicePostfix,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: template,
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
 				ObjectMeta: metav1.ObjectMeta{
+					Name:   mysqlDataVolumeName,
 					Labels: labels,
 				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{{
-						Image: "mysql:5.7",
-						Name:  "visitors-mysql",
-						Ports: []corev1.ContainerPort{{
-							ContainerPort: 3306,
-							Name:          "mysql",
-						}},
-						Env: []corev1.EnvVar{
-							{
-								Name:  "MYSQL_ROOT_PASSWORD",
-								Value: "password",
-							},
-							{
-								Name:  "MYSQL_DATABASE",
-								Value: "visitors",
-							},
-							{
-								Name:      "MYSQL_USER",
-								ValueFrom: userSecret,
-							},
-							{
-								Name:      "MYSQL_PASSWORD",
-								ValueFrom: passwordSecret,
-							},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					StorageClassName: storage.StorageClassName,
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceStorage: storage.Size,
 						},
-					}},
+					},
 				},
-			},
+			}},
 		},
 	}
 
-	controllerutil.SetControllerReference(v, dep, scheme)
-	return dep
+	controllerutil.SetControllerReference(v, sts, scheme)
+	return sts
+}
+
+// mysqlReplicas returns the replica count of the MySQL workload. Apps
+// admitted before the webhook rejected more than one replica are capped, the
+// pods would each hold a database of their own.
+func mysqlReplicas(v *appv1beta1.VisitorsApp) *int32 {
+	replicas := tierReplicas(v.Spec.Database.MySQL.TierSpec, appv1beta1.DefaultMySQLReplicas)
+	if *replicas > appv1beta1.MaxMySQLReplicas {
+		*replicas = appv1beta1.MaxMySQLReplicas
+	}
+	return replicas
+}
+
+// expandDataClaims grows the data volume claims of the MySQL statefulset up to
+// the size requested in the spec. Claims are never shrunk.
+func (m *mysqlEnsurer) expandDataClaims(ctx context.Context, v *appv1beta1.VisitorsApp) error {
+	size := v.Spec.Database.MySQL.Storage.Size
+
+	claims := &corev1.PersistentVolumeClaimList{}
+	err := m.client.List(ctx, claims,
+		client.InNamespace(v.Namespace),
+		client.MatchingLabels(labels(v, "mysql")),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		current := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+		if current.Cmp(size) >= 0 {
+			continue
+		}
+
+		patch := client.MergeFrom(claim.DeepCopy())
+		if claim.Spec.Resources.Requests == nil {
+			claim.Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		claim.Spec.Resources.Requests[corev1.ResourceStorage] = size
+		logf.FromContext(ctx).Info("Expanding volume claim", "kind", "PersistentVolumeClaim", "object", claim.Name,
+			"from", current.String(), "to", size.String())
+		if err := m.client.Patch(ctx, claim, patch); err != nil {
+			m.recorder.Eventf(v, corev1.EventTypeWarning, "ExpandFailed",
+				"Failed to expand PersistentVolumeClaim %s: %v", claim.Name, err)
+			return err
+		}
+		m.recorder.Eventf(v, corev1.EventTypeNormal, "Expanding",
+			"Expanding PersistentVolumeClaim %s from %s to %s", claim.Name, current.String(), size.String())
+	}
+	return nil
 }
 
-func (m *mysqlEnsurer) mysqlService(v *appv1alpha1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
+func (m *mysqlEnsurer) mysqlService(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *corev1.Service {
 	labels := labels(v, "mysql")
 
 	s := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      m.serviceName,
+			Name:      v.Name + m.servicePostfix,
 			Namespace: v.Namespace,
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: labels,
 			Ports: []corev1.ServicePort{{
-				Port: 3306,
+				Protocol: corev1.ProtocolTCP,
+				Port:     3306,
 			}},
 			ClusterIP: "None",
 		},
@@ -183,14 +464,20 @@ func (m *mysqlEnsurer) mysqlService(v *appv1alpha1.VisitorsApp, scheme *runtime.
 
 func NewMysqlEnsurer(
 	cli client.Client,
-	deploymentName string,
-	serviceName string,
-	authName string,
+	recorder record.EventRecorder,
+	deploymentPostfix string,
+	servicePostfix string,
+	authPostfix string,
+	migrationPostfix string,
+	image string,
 ) WorkloadEnsurer {
 	return &mysqlEnsurer{
-		client:         cli,
-		deploymentName: deploymentName,
-		serviceName:    serviceName,
-		authName:       authName,
+		client:            cli,
+		recorder:          recorder,
+		deploymentPostfix: deploymentPostfix,
+		servicePostfix:    servicePostfix,
+		authPostfix:       authPostfix,
+		migrationPostfix:  migrationPostfix,
+		image:             image,
 	}
 }
@@ -0,0 +1,284 @@
+package workload_ensurers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MySQL keeps serving, and stays ready, across a rotation of the password of
+// the visitors user: its pods aren't rolled and their probe doesn't use it
+func TestMysqlStaysReadyAcrossPasswordRotation(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestApp()
+	instance.Spec.Database.MySQL.PasswordRotation = &appv1beta1.PasswordRotationSpec{
+		Interval: metav1.Duration{Duration: time.Hour},
+	}
+	cli := newTestClient(t, instance)
+	recorder := newTestRecorder()
+	scheme := cli.Scheme()
+	request := newTestRequest(instance)
+
+	director := NewEnsureWorkloadDirector()
+	database := NewDatabaseEnsurer(
+		NewMysqlEnsurer(cli, recorder, "-mysql", "-mysql-service", "-mysql-auth", "-mysql-migration", appv1beta1.DefaultMySQLImage),
+		NewExternalDatabaseEnsurer(cli, recorder),
+	)
+	rotation := NewRotationEnsurer(cli, recorder, appv1beta1.DefaultMySQLImage,
+		"-mysql-password-rotation", "-mysql-auth-pending", "-mysql-service", "-mysql-auth")
+
+	ensureMysql := func() {
+		t.Helper()
+		if _, err := director.EnsureTier(ctx, database, "mysql", appv1beta1.ConditionMySQLReady,
+			request, instance, scheme); err != nil {
+			t.Fatalf("ensuring mysql: %v", err)
+		}
+	}
+	ensureRotation := func() {
+		t.Helper()
+		if _, err := director.EnsureTier(ctx, rotation, "rotation", "", request, instance, scheme); err != nil {
+			t.Fatalf("ensuring the rotation: %v", err)
+		}
+	}
+	deploymentKey := types.NamespacedName{Name: "app-mysql", Namespace: "default"}
+
+	// Bring MySQL up
+	ensureMysql()
+	deployment := &appsv1.Deployment{}
+	if err := cli.Get(ctx, deploymentKey, deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Status.ReadyReplicas = 1
+	if err := cli.Status().Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	ensureMysql()
+	if !meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionMySQLReady) {
+		t.Fatalf("%s isn't true before the rotation", appv1beta1.ConditionMySQLReady)
+	}
+	if err := cli.Get(ctx, deploymentKey, deployment); err != nil {
+		t.Fatal(err)
+	}
+	before := deployment.Spec.Template.DeepCopy()
+	oldPassword := authPassword(ctx, t, cli)
+
+	// Rotate: the pending password is generated and the job started, then
+	// the job succeeds and the password is handed over
+	ensureRotation()
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql-password-rotation", Namespace: "default"}, job); err != nil {
+		t.Fatalf("rotation job wasn't created: %v", err)
+	}
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	ensureRotation()
+	if authPassword(ctx, t, cli) == oldPassword {
+		t.Fatal("the password wasn't rotated")
+	}
+
+	ensureMysql()
+	if !meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionMySQLReady) {
+		t.Errorf("%s isn't true after the rotation", appv1beta1.ConditionMySQLReady)
+	}
+	if err := cli.Get(ctx, deploymentKey, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(before, &deployment.Spec.Template) {
+		t.Errorf("the MySQL pods were rolled by the rotation")
+	}
+	probe := deployment.Spec.Template.Spec.Containers[0].ReadinessProbe
+	if strings.Contains(strings.Join(probe.Exec.Command, " "), "PASSWORD") {
+		t.Errorf("the readiness probe %q depends on a password read at start", probe.Exec.Command)
+	}
+}
+
+// Adding storage to an app running MySQL as a Deployment dumps its data to
+// the volume of the StatefulSet before the Deployment is deleted
+func TestMysqlMigratesDeploymentDataToStatefulSet(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestApp()
+	cli := newTestClient(t, instance)
+	scheme := cli.Scheme()
+	request := newTestRequest(instance)
+
+	director := NewEnsureWorkloadDirector()
+	mysql := NewMysqlEnsurer(cli, newTestRecorder(), "-mysql", "-mysql-service", "-mysql-auth", "-mysql-migration", appv1beta1.DefaultMySQLImage)
+	ensureMysql := func() {
+		t.Helper()
+		if _, err := director.EnsureTier(ctx, mysql, "mysql", appv1beta1.ConditionMySQLReady,
+			request, instance, scheme); err != nil {
+			t.Fatalf("ensuring mysql: %v", err)
+		}
+	}
+	key := types.NamespacedName{Name: "app-mysql", Namespace: "default"}
+	jobKey := types.NamespacedName{Name: "app-mysql-migration", Namespace: "default"}
+
+	ensureMysql()
+	if err := cli.Get(ctx, key, &appsv1.Deployment{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Deployment keeps serving while its data is dumped
+	instance.Spec.Database.MySQL.Storage = &appv1beta1.MySQLStorageSpec{Size: resource.MustParse("1Gi")}
+	ensureMysql()
+	if err := cli.Get(ctx, key, &appsv1.Deployment{}); err != nil {
+		t.Fatalf("the Deployment was deleted before its data was migrated: %v", err)
+	}
+	if err := cli.Get(ctx, key, &appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+		t.Fatalf("the StatefulSet was created before the data was migrated: %v", err)
+	}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "data-app-mysql-0", Namespace: "default"},
+		&corev1.PersistentVolumeClaim{}); err != nil {
+		t.Fatalf("the volume claim of the StatefulSet wasn't created: %v", err)
+	}
+	if !meta.IsStatusConditionFalse(instance.Status.Conditions, appv1beta1.ConditionStorageMigrated) {
+		t.Errorf("%s isn't false while migrating", appv1beta1.ConditionStorageMigrated)
+	}
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, jobKey, job); err != nil {
+		t.Fatalf("migration job wasn't created: %v", err)
+	}
+	if claim := job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "data-app-mysql-0" {
+		t.Errorf("migration job volume = %+v, want the claim of the first StatefulSet pod", job.Spec.Template.Spec.Volumes[0])
+	}
+
+	// Once the dump is complete the StatefulSet takes over and loads it
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	ensureMysql()
+	if err := cli.Get(ctx, key, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+		t.Errorf("the Deployment wasn't deleted after the migration: %v", err)
+	}
+	if err := cli.Get(ctx, jobKey, &batchv1.Job{}); !errors.IsNotFound(err) {
+		t.Errorf("the migration job wasn't deleted: %v", err)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := cli.Get(ctx, key, sts); err != nil {
+		t.Fatal(err)
+	}
+	loadsDump := false
+	for _, mount := range sts.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if mount.MountPath == "/docker-entrypoint-initdb.d" && mount.SubPath == mysqlInitSubPath {
+			loadsDump = true
+		}
+	}
+	if !loadsDump {
+		t.Error("the StatefulSet doesn't load the dump when it initializes its data directory")
+	}
+	if !meta.IsStatusConditionTrue(instance.Status.Conditions, appv1beta1.ConditionStorageMigrated) {
+		t.Errorf("%s isn't true after the migration", appv1beta1.ConditionStorageMigrated)
+	}
+}
+
+func authPassword(ctx context.Context, t *testing.T, cli client.Client) string {
+	t.Helper()
+	secret := &corev1.Secret{}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql-auth", Namespace: "default"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data[mysqlPasswordKey])
+}
+
+// The objects left under the legacy names hand their credentials and data over
+// to the ones named after the instance before they are deleted
+func TestMysqlMigratesLegacyObjects(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestApp()
+	instance.Spec.Database.MySQL.Storage = &appv1beta1.MySQLStorageSpec{Size: resource.MustParse("1Gi")}
+	legacy := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(instance, appv1beta1.GroupVersion.WithKind("VisitorsApp"))},
+		}
+	}
+	cli := newTestClient(t, instance,
+		&appsv1.Deployment{ObjectMeta: legacy("mysql")},
+		&corev1.Service{ObjectMeta: legacy("mysql-service")},
+		&corev1.Secret{ObjectMeta: legacy("mysql-auth"), Data: map[string][]byte{
+			mysqlUsernameKey: []byte("visitors-user"),
+			mysqlPasswordKey: []byte("legacy-password"),
+		}},
+	)
+	scheme := cli.Scheme()
+	request := newTestRequest(instance)
+
+	director := NewEnsureWorkloadDirector()
+	mysql := NewMysqlEnsurer(cli, newTestRecorder(), "-mysql", "-mysql-service", "-mysql-auth", "-mysql-migration", appv1beta1.DefaultMySQLImage)
+	ensureMysql := func() {
+		t.Helper()
+		if _, err := director.EnsureTier(ctx, mysql, "mysql", appv1beta1.ConditionMySQLReady,
+			request, instance, scheme); err != nil {
+			t.Fatalf("ensuring mysql: %v", err)
+		}
+	}
+	legacyKey := types.NamespacedName{Name: "mysql", Namespace: "default"}
+	jobKey := types.NamespacedName{Name: "app-mysql-migration", Namespace: "default"}
+
+	ensureMysql()
+	secret := &corev1.Secret{}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql-auth", Namespace: "default"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data[mysqlPasswordKey]); got != "legacy-password" {
+		t.Errorf("password = %q, want the one of the legacy secret", got)
+	}
+	if got := string(secret.Data[mysqlRootPasswordKey]); got != "password" {
+		t.Errorf("root password = %q, want the one the legacy database was initialized with", got)
+	}
+	if err := cli.Get(ctx, legacyKey, &appsv1.Deployment{}); err != nil {
+		t.Fatalf("the legacy Deployment was deleted before its data was migrated: %v", err)
+	}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql", Namespace: "default"},
+		&appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+		t.Fatalf("the StatefulSet was created before the legacy data was migrated: %v", err)
+	}
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, jobKey, job); err != nil {
+		t.Fatalf("migration job wasn't created: %v", err)
+	}
+	for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "MYSQL_HOST" && env.Value != "mysql-service" {
+			t.Errorf("migration job dumps %q, want the legacy service", env.Value)
+		}
+	}
+
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	ensureMysql()
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &corev1.Service{}, &corev1.Secret{}} {
+		key := legacyKey
+		switch obj.(type) {
+		case *corev1.Service:
+			key.Name = "mysql-service"
+		case *corev1.Secret:
+			key.Name = "mysql-auth"
+		}
+		if err := cli.Get(ctx, key, obj); !errors.IsNotFound(err) {
+			t.Errorf("legacy %T %s wasn't deleted: %v", obj, key.Name, err)
+		}
+	}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql", Namespace: "default"},
+		&appsv1.StatefulSet{}); err != nil {
+		t.Errorf("the StatefulSet wasn't created after the migration: %v", err)
+	}
+}
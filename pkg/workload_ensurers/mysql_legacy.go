@@ -0,0 +1,103 @@
+package workload_ensurers
+
+import (
+	"context"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Names of the MySQL objects from before they were derived from the instance
+const (
+	legacyMysqlDeploymentName = "mysql"
+	legacyMysqlServiceName    = "mysql-service"
+	legacyMysqlAuthName       = "mysql-auth"
+)
+
+// migrateLegacy replaces the MySQL objects left under their legacy names. The
+// legacy workload selects the same pods as the new one, so it must be gone
+// before the new one is ensured. With storage its database is dumped to the
+// volume of the StatefulSet first, like a Deployment the storage is added to.
+// Without storage the database lives in the pod filesystem, which any rollout
+// of the workload starts afresh. Objects of another app of the namespace are
+// left alone, and so are the legacy data volume claims, which were never owned
+// by the instance. It returns whether the new workload can be ensured.
+func (m *mysqlEnsurer) migrateLegacy(
+	ctx context.Context,
+	v *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (bool, error) {
+	key := metav1.ObjectMeta{Name: legacyMysqlDeploymentName, Namespace: v.Namespace}
+
+	workload, err := m.legacyWorkload(ctx, v)
+	if err != nil {
+		return false, err
+	}
+
+	if workload != nil && v.Spec.Database.MySQL.Storage != nil {
+		migrated, err := m.migrateWorkload(ctx, v, workload, legacyMysqlServiceName, scheme)
+		if err != nil || !migrated {
+			return false, err
+		}
+	}
+
+	// The database was dumped through the legacy service, and the secret
+	// holds the credentials of the legacy workload
+	for _, obj := range []client.Object{
+		&appsv1.Deployment{ObjectMeta: key},
+		&appsv1.StatefulSet{ObjectMeta: key},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: legacyMysqlServiceName, Namespace: v.Namespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: legacyMysqlAuthName, Namespace: v.Namespace}},
+	} {
+		if err := deleteOwnedObject(ctx, v, obj, m.client, m.recorder); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// legacyWorkload returns the legacy Deployment or StatefulSet controlled by
+// the instance, or nil if there's none
+func (m *mysqlEnsurer) legacyWorkload(ctx context.Context, v *appv1beta1.VisitorsApp) (client.Object, error) {
+	key := types.NamespacedName{Name: legacyMysqlDeploymentName, Namespace: v.Namespace}
+	for _, workload := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}} {
+		err := m.client.Get(ctx, key, workload)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if metav1.IsControlledBy(workload, v) {
+			return workload, nil
+		}
+	}
+	return nil, nil
+}
+
+// legacyAuthData returns the credentials of the legacy secret of the instance,
+// the legacy database was initialized with them. It returns nil if there's no
+// such secret.
+func (m *mysqlEnsurer) legacyAuthData(ctx context.Context, v *appv1beta1.VisitorsApp) (map[string][]byte, error) {
+	secret := &corev1.Secret{}
+	err := m.client.Get(ctx, types.NamespacedName{
+		Name:      legacyMysqlAuthName,
+		Namespace: v.Namespace,
+	}, secret)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !metav1.IsControlledBy(secret, v) {
+		return nil, nil
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,187 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// mysqlInitSubPath is the directory of the data volume mounted as the init
+// scripts of MySQL. The image runs them only when it initializes an empty
+// data directory, so a dump left there is loaded exactly once.
+const mysqlInitSubPath = "migration"
+
+// migrationScript dumps the visitors database to the init scripts directory
+// of the data volume
+const migrationScript = `set -eo pipefail
+mkdir -p "/data/$INIT_DIR"
+mysqldump --single-transaction --no-tablespaces \
+  -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u "$MYSQL_USER" "$MYSQL_DATABASE" \
+  | gzip > "/data/$INIT_DIR/visitors.sql.gz.tmp"
+mv "/data/$INIT_DIR/visitors.sql.gz.tmp" "/data/$INIT_DIR/visitors.sql.gz"
+`
+
+// migrateDeployment carries the data of a Deployment based MySQL over to the
+// StatefulSet replacing it. Until the StatefulSet exists the Deployment is the
+// only one serving the database, so a job dumps it through the service to the
+// volume claim of the first StatefulSet pod, which loads the dump when it
+// starts. The Deployment is only deleted once the dump is complete. It
+// returns whether the StatefulSet can be ensured.
+func (m *mysqlEnsurer) migrateDeployment(
+	ctx context.Context,
+	v *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (bool, error) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:      v.Name + m.deploymentPostfix,
+		Namespace: v.Namespace,
+	}}
+	return m.migrateWorkload(ctx, v, deployment, v.Name+m.servicePostfix, scheme)
+}
+
+// migrateWorkload dumps the database of the workload, reached through the
+// given host, to the volume claim of the first StatefulSet pod and deletes the
+// workload once the dump is complete. It returns whether the workload is gone.
+func (m *mysqlEnsurer) migrateWorkload(
+	ctx context.Context,
+	v *appv1beta1.VisitorsApp,
+	workload client.Object,
+	host string,
+	scheme *runtime.Scheme,
+) (bool, error) {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: v.Name + m.migrationPostfix, Namespace: v.Namespace}}
+
+	gvk, err := apiutil.GVKForObject(workload, scheme)
+	if err != nil {
+		return false, err
+	}
+	err = m.client.Get(ctx, client.ObjectKeyFromObject(workload), workload)
+	if errors.IsNotFound(err) || (err == nil && !metav1.IsControlledBy(workload, v)) {
+		// Nothing to migrate, drop the job of a migration cut short
+		return true, deleteOwnedObject(ctx, v, job, m.client, m.recorder)
+	} else if err != nil {
+		return false, err
+	}
+
+	sts := m.mysqlStatefulSet(v, scheme)
+	claim := sts.Spec.VolumeClaimTemplates[0].DeepCopy()
+	claim.Name = fmt.Sprintf("%s-%s-0", claim.Name, sts.Name)
+	claim.Namespace = v.Namespace
+	message := fmt.Sprintf("Copying the data of %s %s to PersistentVolumeClaim %s", gvk.Kind, workload.GetName(), claim.Name)
+
+	err = m.client.Get(ctx, client.ObjectKeyFromObject(job), job)
+	if errors.IsNotFound(err) {
+		// The StatefulSet adopts the claim by its name, like the ones it
+		// creates it isn't owned by the instance
+		logf.FromContext(ctx).Info("Creating volume claim", "kind", "PersistentVolumeClaim", "object", claim.Name)
+		err = m.client.Create(ctx, claim)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return false, err
+		}
+
+		logf.FromContext(ctx).Info("Creating the migration Job", "kind", "Job", "object", job.Name)
+		err = m.client.Create(ctx, m.migrationJob(v, claim.Name, host, scheme))
+		if err != nil {
+			return false, err
+		}
+		v.SetCondition(appv1beta1.ConditionStorageMigrated, metav1.ConditionFalse, "MigrationInProgress", message)
+		m.recorder.Event(v, corev1.EventTypeNormal, "MigrationStarted", message)
+		// The job completion triggers the next reconcile
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if jobFailed(job) {
+		err = fmt.Errorf("migration job %q failed, delete it to retry", job.Name)
+		v.SetCondition(appv1beta1.ConditionStorageMigrated, metav1.ConditionFalse, "MigrationFailed", err.Error())
+		m.recorder.Event(v, corev1.EventTypeWarning, "MigrationFailed", err.Error())
+		return false, err
+	}
+	if job.Status.Succeeded == 0 {
+		return false, nil
+	}
+
+	// Drop the job first, should deleting the workload fail the next
+	// reconcile dumps the database again
+	if err = deleteOwnedObject(ctx, v, job, m.client, m.recorder); err != nil {
+		return false, err
+	}
+	if err = deleteOwnedObject(ctx, v, workload, m.client, m.recorder); err != nil {
+		return false, err
+	}
+	message = fmt.Sprintf("Copied the data of %s %s to PersistentVolumeClaim %s", gvk.Kind, workload.GetName(), claim.Name)
+	v.SetCondition(appv1beta1.ConditionStorageMigrated, metav1.ConditionTrue, "Migrated", message)
+	m.recorder.Event(v, corev1.EventTypeNormal, "Migrated", message)
+	return true, nil
+}
+
+func (m *mysqlEnsurer) migrationJob(
+	v *appv1beta1.VisitorsApp,
+	claimName string,
+	host string,
+	scheme *runtime.Scheme,
+) *batchv1.Job {
+	labels := labels(v, "migration")
+	// The database is reached through the given host, the legacy workload
+	// has a Service of its own
+	database := visitorsDatabase(v, m.servicePostfix, m.authPostfix)
+	database.host = host
+	backoffLimit := int32(2)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + m.migrationPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Image:   tierImage(v.Spec.Database.MySQL.TierSpec, m.image),
+						Name:    "visitors-migration",
+						Command: []string{"bash", "-c", migrationScript},
+						Env: append(databaseClientEnv(database),
+							corev1.EnvVar{
+								Name:  "INIT_DIR",
+								Value: mysqlInitSubPath,
+							},
+						),
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      mysqlDataVolumeName,
+							MountPath: "/data",
+						}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: mysqlDataVolumeName,
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+								ClaimName: claimName,
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, job, scheme)
+	return job
+}
@@ -0,0 +1,218 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const restoreVolumeName = "restore"
+
+// restoreScript loads the dump into the visitors database
+const restoreScript = `set -eo pipefail
+case "$RESTORE_FILE" in
+  *.gz) gunzip -c "/restore/$RESTORE_FILE" ;;
+  *) cat "/restore/$RESTORE_FILE" ;;
+esac | mysql -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u "$MYSQL_USER" "$MYSQL_DATABASE"
+`
+
+type restoreEnsurer struct {
+	client              client.Client
+	recorder            record.EventRecorder
+	image               string
+	jobPostfix          string
+	mysqlServicePostfix string
+	mysqlAuthPostfix    string
+}
+
+// EnsureDeployment starts the one-shot restore job. It returns an error once
+// the job has failed; deleting the job retries the restore.
+func (r *restoreEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if !restorePending(instance) {
+		return nil, nil
+	}
+
+	found := &batchv1.Job{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.jobPostfix,
+		Namespace: instance.Namespace,
+	}, found)
+	if err != nil && errors.IsNotFound(err) {
+		// The job template is immutable, so the job is only created once
+		logf.FromContext(ctx).Info("Creating the restore Job", "kind", "Job", "object", instance.Name+r.jobPostfix)
+		err = r.client.Create(ctx, r.restoreJob(instance, scheme))
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		r.recorder.Eventf(instance, corev1.EventTypeNormal, "RestoreStarted",
+			"Restoring %s from PersistentVolumeClaim %s",
+			instance.Spec.Database.MySQL.RestoreFrom.File, instance.Spec.Database.MySQL.RestoreFrom.ClaimName)
+		return nil, nil
+	} else if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	if jobFailed(found) {
+		err = fmt.Errorf("restore job %q failed, delete it to retry", found.Name)
+		instance.SetCondition(appv1beta1.ConditionRestored, metav1.ConditionFalse,
+			"RestoreFailed", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, "RestoreFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	return nil, nil
+}
+
+func (r *restoreEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+func (r *restoreEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+// CheckWorkload returns whether the restore is done, or wasn't asked for,
+// and records its progress in the instance conditions
+func (r *restoreEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	if !restorePending(instance) {
+		return true
+	}
+
+	job := &batchv1.Job{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.jobPostfix,
+		Namespace: instance.Namespace,
+	}, job)
+	if err != nil || job.Status.Succeeded == 0 {
+		instance.SetCondition(appv1beta1.ConditionRestored, metav1.ConditionFalse,
+			"RestoreInProgress", "Loading "+instance.Spec.Database.MySQL.RestoreFrom.File)
+		return false
+	}
+
+	instance.SetCondition(appv1beta1.ConditionRestored, metav1.ConditionTrue,
+		"RestoreSucceeded", "Loaded "+instance.Spec.Database.MySQL.RestoreFrom.File)
+	r.recorder.Event(instance, corev1.EventTypeNormal, "RestoreSucceeded",
+		"Loaded "+instance.Spec.Database.MySQL.RestoreFrom.File)
+	return true
+}
+
+func (r *restoreEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	return nil
+}
+
+func (r *restoreEnsurer) restoreJob(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *batchv1.Job {
+	labels := labels(v, "restore")
+	source := v.Spec.Database.MySQL.RestoreFrom
+	database := visitorsDatabase(v, r.mysqlServicePostfix, r.mysqlAuthPostfix)
+	backoffLimit := int32(2)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + r.jobPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Image:   tierImage(v.Spec.Database.MySQL.TierSpec, r.image),
+						Name:    "visitors-restore",
+						Command: []string{"bash", "-c", restoreScript},
+						Env: append(databaseClientEnv(database),
+							corev1.EnvVar{
+								Name:  "RESTORE_FILE",
+								Value: source.File,
+							},
+						),
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      restoreVolumeName,
+							MountPath: "/restore",
+							ReadOnly:  true,
+						}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: restoreVolumeName,
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+								ClaimName: source.ClaimName,
+								ReadOnly:  true,
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, job, scheme)
+	return job
+}
+
+// restorePending returns whether the instance asks for a restore that hasn't
+// completed yet. A restore only ever runs once, against the in-cluster MySQL.
+func restorePending(v *appv1beta1.VisitorsApp) bool {
+	return v.Spec.Database.MySQL.RestoreFrom != nil &&
+		v.Spec.Database.External == nil &&
+		!meta.IsStatusConditionTrue(v.Status.Conditions, appv1beta1.ConditionRestored)
+}
+
+// jobFailed returns whether the job has given up
+func jobFailed(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func NewRestoreEnsurer(
+	cli client.Client,
+	recorder record.EventRecorder,
+	image string,
+	jobPostfix string,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) WorkloadEnsurer {
+	return &restoreEnsurer{
+		client:              cli,
+		recorder:            recorder,
+		image:               image,
+		jobPostfix:          jobPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+	}
+}
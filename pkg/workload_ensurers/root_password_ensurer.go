@@ -0,0 +1,304 @@
+package workload_ensurers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Keys of the secret holding the root password applied to MySQL
+const (
+	appliedRootPasswordKey = "root-password"
+	pendingRootPasswordKey = "pending-root-password"
+)
+
+// rootPasswordScript changes the root password to the new one and checks that
+// it works. A retry after a successful change finds the new password already
+// in place.
+const rootPasswordScript = `set -eo pipefail
+check() {
+  MYSQL_PWD="$NEW_PASSWORD" mysql -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u root -e 'SELECT 1' > /dev/null
+}
+if check 2> /dev/null; then
+  exit 0
+fi
+new="${NEW_PASSWORD//\\/\\\\}"
+new="${new//\'/\\\'}"
+MYSQL_PWD="$OLD_PASSWORD" mysql -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u root \
+  -e "ALTER USER IF EXISTS 'root'@'%' IDENTIFIED BY '$new'; ALTER USER IF EXISTS 'root'@'localhost' IDENTIFIED BY '$new'"
+check
+`
+
+// rootPasswordEnsurer applies a change of the root password in the credentials
+// secret to the running MySQL. MySQL only reads the root password of its
+// environment when it initializes the data directory, so rolling its pods
+// wouldn't change it, and would wipe the data of a Deployment without storage.
+// The password MySQL has is kept in a secret of its own, which the job logs
+// in with.
+type rootPasswordEnsurer struct {
+	client              client.Client
+	recorder            record.EventRecorder
+	image               string
+	jobPostfix          string
+	secretPostfix       string
+	mysqlServicePostfix string
+	mysqlAuthPostfix    string
+}
+
+// EnsureDeployment runs the job changing the root password when it differs
+// from the applied one, and records the new password once it has succeeded
+func (r *rootPasswordEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if instance.Spec.Database.External != nil {
+		return nil, nil
+	}
+
+	applied := &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.secretPostfix,
+		Namespace: instance.Namespace,
+	}, applied)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	// Set the target aside, the credentials secret may change again while
+	// the job runs
+	if len(applied.Data[pendingRootPasswordKey]) == 0 {
+		rootPassword, err := r.rootPassword(ctx, instance)
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		if bytes.Equal(rootPassword, applied.Data[appliedRootPasswordKey]) {
+			return nil, nil
+		}
+		patch := client.MergeFrom(applied.DeepCopy())
+		applied.Data[pendingRootPasswordKey] = rootPassword
+		logf.FromContext(ctx).Info("Changing the root password", "kind", "Secret", "object", applied.Name)
+		if err = r.client.Patch(ctx, applied, patch); err != nil {
+			return &reconcile.Result{}, err
+		}
+	}
+
+	job := &batchv1.Job{}
+	err = r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.jobPostfix,
+		Namespace: instance.Namespace,
+	}, job)
+	if errors.IsNotFound(err) {
+		logf.FromContext(ctx).Info("Creating the root password Job", "kind", "Job", "object", instance.Name+r.jobPostfix)
+		err = r.client.Create(ctx, r.rootPasswordJob(instance, scheme))
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		r.recorder.Event(instance, corev1.EventTypeNormal, "RootPasswordChangeStarted",
+			"Changing the MySQL root password")
+		// The job completion triggers the next reconcile
+		return &reconcile.Result{}, nil
+	} else if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	if jobFailed(job) {
+		err = fmt.Errorf("root password job %q failed, delete it to retry", job.Name)
+		r.recorder.Event(instance, corev1.EventTypeWarning, "RootPasswordChangeFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	if job.Status.Succeeded == 0 {
+		return &reconcile.Result{}, nil
+	}
+
+	// MySQL accepts the new password, log in with it from now on
+	patch := client.MergeFrom(applied.DeepCopy())
+	applied.Data[appliedRootPasswordKey] = applied.Data[pendingRootPasswordKey]
+	delete(applied.Data, pendingRootPasswordKey)
+	if err = r.client.Patch(ctx, applied, patch); err != nil {
+		return &reconcile.Result{}, err
+	}
+	if err = deleteOwnedObject(ctx, instance, job, r.client, r.recorder); err != nil {
+		return &reconcile.Result{}, err
+	}
+	r.recorder.Event(instance, corev1.EventTypeNormal, "RootPasswordChanged", "Changed the MySQL root password")
+	return nil, nil
+}
+
+func (r *rootPasswordEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+// EnsureSecret creates the secret holding the applied root password. MySQL
+// was initialized with the password of the credentials secret, so that's
+// where it starts from.
+func (r *rootPasswordEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	key := metav1.ObjectMeta{Name: instance.Name + r.secretPostfix, Namespace: instance.Namespace}
+
+	if instance.Spec.Database.External != nil {
+		for _, obj := range []client.Object{
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: instance.Name + r.jobPostfix, Namespace: instance.Namespace}},
+			&corev1.Secret{ObjectMeta: key},
+		} {
+			if err := deleteOwnedObject(ctx, instance, obj, r.client, r.recorder); err != nil {
+				return &reconcile.Result{}, err
+			}
+		}
+		return nil, nil
+	}
+
+	err := r.client.Get(ctx, types.NamespacedName{Name: key.Name, Namespace: key.Namespace}, &corev1.Secret{})
+	if err == nil {
+		return nil, nil
+	} else if !errors.IsNotFound(err) {
+		return &reconcile.Result{}, err
+	}
+
+	rootPassword, err := r.rootPassword(ctx, instance)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	applied := &corev1.Secret{
+		ObjectMeta: key,
+		Type:       corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			appliedRootPasswordKey: rootPassword,
+		},
+	}
+	controllerutil.SetControllerReference(instance, applied, scheme)
+
+	logf.FromContext(ctx).Info("Recording the applied root password", "kind", "Secret", "object", applied.Name)
+	if err = r.client.Create(ctx, applied); err != nil {
+		return &reconcile.Result{}, err
+	}
+	return nil, nil
+}
+
+func (r *rootPasswordEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return true
+}
+
+func (r *rootPasswordEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	return nil
+}
+
+// rootPassword returns the root password of the credentials secret
+func (r *rootPasswordEnsurer) rootPassword(ctx context.Context, v *appv1beta1.VisitorsApp) ([]byte, error) {
+	auth := &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      mysqlAuthSecretName(v, r.mysqlAuthPostfix),
+		Namespace: v.Namespace,
+	}, auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(auth.Data[mysqlRootPasswordKey]) == 0 {
+		return nil, fmt.Errorf("credentials secret %q has no %q key", auth.Name, mysqlRootPasswordKey)
+	}
+	return auth.Data[mysqlRootPasswordKey], nil
+}
+
+func (r *rootPasswordEnsurer) rootPasswordJob(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *batchv1.Job {
+	labels := labels(v, "root-password")
+	database := visitorsDatabase(v, r.mysqlServicePostfix, r.mysqlAuthPostfix)
+	backoffLimit := int32(2)
+
+	appliedPassword := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: v.Name + r.secretPostfix},
+				Key:                  key,
+			},
+		}
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + r.jobPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Image:   tierImage(v.Spec.Database.MySQL.TierSpec, r.image),
+						Name:    "visitors-root-password",
+						Command: []string{"bash", "-c", rootPasswordScript},
+						Env: []corev1.EnvVar{
+							{
+								Name:  "MYSQL_HOST",
+								Value: database.host,
+							},
+							{
+								Name:  "MYSQL_PORT",
+								Value: strconv.Itoa(int(database.port)),
+							},
+							{
+								Name:      "OLD_PASSWORD",
+								ValueFrom: appliedPassword(appliedRootPasswordKey),
+							},
+							{
+								Name:      "NEW_PASSWORD",
+								ValueFrom: appliedPassword(pendingRootPasswordKey),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, job, scheme)
+	return job
+}
+
+func NewRootPasswordEnsurer(
+	cli client.Client,
+	recorder record.EventRecorder,
+	image string,
+	jobPostfix string,
+	secretPostfix string,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) WorkloadEnsurer {
+	return &rootPasswordEnsurer{
+		client:              cli,
+		recorder:            recorder,
+		image:               image,
+		jobPostfix:          jobPostfix,
+		secretPostfix:       secretPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+	}
+}
@@ -0,0 +1,101 @@
+package workload_ensurers
+
+import (
+	"context"
+	"testing"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// A new root password in the credentials secret is applied by a job logging
+// in with the old one, without rolling the MySQL pods
+func TestRootPasswordChangeRunsJobWithoutRollingMysql(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestApp()
+	instance.Spec.Database.MySQL.Storage = &appv1beta1.MySQLStorageSpec{Size: resource.MustParse("1Gi")}
+	cli := newTestClient(t, instance)
+	recorder := newTestRecorder()
+	scheme := cli.Scheme()
+	request := newTestRequest(instance)
+
+	director := NewEnsureWorkloadDirector()
+	mysql := NewMysqlEnsurer(cli, recorder, "-mysql", "-mysql-service", "-mysql-auth", "-mysql-migration", appv1beta1.DefaultMySQLImage)
+	rootPassword := NewRootPasswordEnsurer(cli, recorder, appv1beta1.DefaultMySQLImage,
+		"-mysql-root-password", "-mysql-root-applied", "-mysql-service", "-mysql-auth")
+
+	ensure := func(name string, ensurer WorkloadEnsurer) {
+		t.Helper()
+		if _, err := director.EnsureTier(ctx, ensurer, name, "", request, instance, scheme); err != nil {
+			t.Fatalf("ensuring %s: %v", name, err)
+		}
+	}
+	authKey := types.NamespacedName{Name: "app-mysql-auth", Namespace: "default"}
+	appliedKey := types.NamespacedName{Name: "app-mysql-root-applied", Namespace: "default"}
+	jobKey := types.NamespacedName{Name: "app-mysql-root-password", Namespace: "default"}
+	statefulSetKey := types.NamespacedName{Name: "app-mysql", Namespace: "default"}
+
+	ensure("mysql", mysql)
+	ensure("root-password", rootPassword)
+	if err := cli.Get(ctx, jobKey, &batchv1.Job{}); !errors.IsNotFound(err) {
+		t.Fatalf("a job was started for an unchanged root password: %v", err)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := cli.Get(ctx, statefulSetKey, sts); err != nil {
+		t.Fatal(err)
+	}
+	before := sts.Spec.Template.DeepCopy()
+
+	// Change the root password
+	auth := &corev1.Secret{}
+	if err := cli.Get(ctx, authKey, auth); err != nil {
+		t.Fatal(err)
+	}
+	oldPassword := string(auth.Data[mysqlRootPasswordKey])
+	auth.Data[mysqlRootPasswordKey] = []byte("new-root-password")
+	if err := cli.Update(ctx, auth); err != nil {
+		t.Fatal(err)
+	}
+
+	ensure("mysql", mysql)
+	ensure("root-password", rootPassword)
+	applied := &corev1.Secret{}
+	if err := cli.Get(ctx, appliedKey, applied); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(applied.Data[appliedRootPasswordKey]); got != oldPassword {
+		t.Errorf("applied root password = %q before the job succeeded, want %q", got, oldPassword)
+	}
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, jobKey, job); err != nil {
+		t.Fatalf("root password job wasn't created: %v", err)
+	}
+
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	ensure("root-password", rootPassword)
+	if err := cli.Get(ctx, appliedKey, applied); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(applied.Data[appliedRootPasswordKey]); got != "new-root-password" {
+		t.Errorf("applied root password = %q after the job succeeded, want the new one", got)
+	}
+	if _, pending := applied.Data[pendingRootPasswordKey]; pending {
+		t.Error("the pending root password wasn't cleared")
+	}
+
+	if err := cli.Get(ctx, statefulSetKey, sts); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(before, &sts.Spec.Template) {
+		t.Error("the MySQL pods were rolled by the root password change")
+	}
+}
@@ -0,0 +1,355 @@
+package workload_ensurers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// rotationScript changes the password of the visitors database user to the
+// new one and checks that it works. A retry after a successful change finds
+// the new password already in place.
+const rotationScript = `set -eo pipefail
+check() {
+  MYSQL_PWD="$NEW_PASSWORD" mysql -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u "$MYSQL_USER" -e 'SELECT 1' "$MYSQL_DATABASE" > /dev/null
+}
+if check 2> /dev/null; then
+  exit 0
+fi
+mysql -h "$MYSQL_HOST" -P "$MYSQL_PORT" -u "$MYSQL_USER" -e "ALTER USER USER() IDENTIFIED BY '$NEW_PASSWORD'"
+check
+`
+
+// passwordRotatedAtAnnotation records on the credentials secret when its
+// password was last rotated. It is set along with the password, so the
+// schedule doesn't depend on the status update of the reconcile going through.
+const passwordRotatedAtAnnotation = "app.my.domain/password-rotated-at"
+
+// rotationEnsurer rotates the password of the visitors database user. The
+// new password is kept in a pending secret until the rotation job has set it
+// in MySQL, and only then copied to the credentials secret, which rolls the
+// backend onto it. The pending secret is only deleted once the credentials
+// secret holds its password.
+type rotationEnsurer struct {
+	client              client.Client
+	recorder            record.EventRecorder
+	image               string
+	jobPostfix          string
+	secretPostfix       string
+	mysqlServicePostfix string
+	mysqlAuthPostfix    string
+}
+
+// EnsureDeployment runs the rotation job of the pending password and, once
+// it has succeeded, copies the password to the credentials secret
+func (r *rotationEnsurer) EnsureDeployment(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	if !rotationEnabled(instance) {
+		return nil, nil
+	}
+
+	pending := &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.secretPostfix,
+		Namespace: instance.Namespace,
+	}, pending)
+	if errors.IsNotFound(err) {
+		// No rotation in progress
+		return nil, nil
+	} else if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	job := &batchv1.Job{}
+	err = r.client.Get(ctx, types.NamespacedName{
+		Name:      instance.Name + r.jobPostfix,
+		Namespace: instance.Namespace,
+	}, job)
+	if errors.IsNotFound(err) {
+		logf.FromContext(ctx).Info("Creating the password rotation Job", "kind", "Job", "object", instance.Name+r.jobPostfix)
+		err = r.client.Create(ctx, r.rotationJob(instance, scheme))
+		if err != nil {
+			return &reconcile.Result{}, err
+		}
+		// The job completion triggers the next reconcile
+		return &reconcile.Result{}, nil
+	} else if err != nil {
+		return &reconcile.Result{}, err
+	}
+
+	if jobFailed(job) {
+		err = fmt.Errorf("password rotation job %q failed, delete it to retry", job.Name)
+		instance.SetCondition(appv1beta1.ConditionPasswordRotated, metav1.ConditionFalse,
+			"RotationFailed", err.Error())
+		r.recorder.Event(instance, corev1.EventTypeWarning, "RotationFailed", err.Error())
+		return &reconcile.Result{}, err
+	}
+	if job.Status.Succeeded == 0 {
+		return &reconcile.Result{}, nil
+	}
+
+	// MySQL accepts the new password, hand it over to the backend
+	auth := &corev1.Secret{}
+	err = r.client.Get(ctx, types.NamespacedName{
+		Name:      mysqlAuthSecretName(instance, r.mysqlAuthPostfix),
+		Namespace: instance.Namespace,
+	}, auth)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	// A retry after the handover finds the password in place already and
+	// keeps the time it was rotated at
+	if !bytes.Equal(auth.Data[mysqlPasswordKey], pending.Data[mysqlPasswordKey]) {
+		patch := client.MergeFrom(auth.DeepCopy())
+		auth.Data[mysqlPasswordKey] = pending.Data[mysqlPasswordKey]
+		if auth.Annotations == nil {
+			auth.Annotations = map[string]string{}
+		}
+		auth.Annotations[passwordRotatedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if err = r.client.Patch(ctx, auth, patch); err != nil {
+			return &reconcile.Result{}, err
+		}
+	}
+
+	for _, obj := range []client.Object{job, pending} {
+		if err = deleteOwnedObject(ctx, instance, obj, r.client, r.recorder); err != nil {
+			return &reconcile.Result{}, err
+		}
+	}
+
+	r.recorder.Event(instance, corev1.EventTypeNormal, "PasswordRotated",
+		"Rotated the password of the visitors database user")
+	return nil, nil
+}
+
+func (r *rotationEnsurer) EnsureService(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return nil, nil
+}
+
+// EnsureSecret starts a rotation once it is due by generating the pending
+// password. Until then it asks to be requeued when the rotation is due.
+func (r *rotationEnsurer) EnsureSecret(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	key := metav1.ObjectMeta{Name: instance.Name + r.secretPostfix, Namespace: instance.Namespace}
+
+	if !rotationEnabled(instance) {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, appv1beta1.ConditionPasswordRotated)
+		// Drop a rotation left in progress
+		for _, obj := range []client.Object{
+			&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: instance.Name + r.jobPostfix, Namespace: instance.Namespace}},
+			&corev1.Secret{ObjectMeta: key},
+		} {
+			if err := deleteOwnedObject(ctx, instance, obj, r.client, r.recorder); err != nil {
+				return &reconcile.Result{}, err
+			}
+		}
+		return nil, nil
+	}
+
+	err := r.client.Get(ctx, types.NamespacedName{Name: key.Name, Namespace: key.Namespace}, &corev1.Secret{})
+	if err == nil {
+		// A rotation is in progress already
+		return nil, nil
+	} else if !errors.IsNotFound(err) {
+		return &reconcile.Result{}, err
+	}
+
+	last, err := r.lastPasswordRotation(ctx, instance)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	next := nextPasswordRotation(instance, last)
+	if wait := time.Until(next); wait > 0 {
+		if last != nil {
+			recordPasswordRotation(instance, last)
+		} else if meta.FindStatusCondition(instance.Status.Conditions, appv1beta1.ConditionPasswordRotated) == nil {
+			instance.SetCondition(appv1beta1.ConditionPasswordRotated, metav1.ConditionTrue,
+				"RotationScheduled", "The first rotation is due at "+next.UTC().Format(time.RFC3339))
+		}
+		return &reconcile.Result{RequeueAfter: wait}, nil
+	}
+
+	password, err := randomPassword(24)
+	if err != nil {
+		return &reconcile.Result{}, err
+	}
+	pending := &corev1.Secret{
+		ObjectMeta: key,
+		Type:       corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			mysqlPasswordKey: []byte(password),
+		},
+	}
+	controllerutil.SetControllerReference(instance, pending, scheme)
+
+	logf.FromContext(ctx).Info("Starting a password rotation", "kind", "Secret", "object", pending.Name)
+	if err = r.client.Create(ctx, pending); err != nil {
+		return &reconcile.Result{}, err
+	}
+	instance.SetCondition(appv1beta1.ConditionPasswordRotated, metav1.ConditionFalse,
+		"RotationInProgress", "Changing the password of the visitors database user")
+	r.recorder.Event(instance, corev1.EventTypeNormal, "RotationStarted",
+		"Rotating the password of the visitors database user")
+	return nil, nil
+}
+
+// CheckWorkload returns whether no rotation is in progress
+func (r *rotationEnsurer) CheckWorkload(ctx context.Context, instance *appv1beta1.VisitorsApp) bool {
+	return !meta.IsStatusConditionFalse(instance.Status.Conditions, appv1beta1.ConditionPasswordRotated)
+}
+
+// UpdateStatus records the last completed rotation, as found on the
+// credentials secret, and when the next one is due
+func (r *rotationEnsurer) UpdateStatus(ctx context.Context, instance *appv1beta1.VisitorsApp) error {
+	if !rotationEnabled(instance) {
+		return nil
+	}
+	last, err := r.lastPasswordRotation(ctx, instance)
+	if err != nil || last == nil {
+		return err
+	}
+	recordPasswordRotation(instance, last)
+	return nil
+}
+
+// lastPasswordRotation returns when the password was last rotated according
+// to the credentials secret. Rotations recorded before the secret carried the
+// time are taken from the status. It is nil when there was none.
+func (r *rotationEnsurer) lastPasswordRotation(ctx context.Context, v *appv1beta1.VisitorsApp) (*metav1.Time, error) {
+	auth := &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{
+		Name:      mysqlAuthSecretName(v, r.mysqlAuthPostfix),
+		Namespace: v.Namespace,
+	}, auth)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if value, ok := auth.Annotations[passwordRotatedAtAnnotation]; ok {
+		rotatedAt, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			last := metav1.NewTime(rotatedAt)
+			return &last, nil
+		}
+		logf.FromContext(ctx).Error(err, "Ignoring an invalid rotation time", "kind", "Secret", "object", auth.Name)
+	}
+	return v.Status.LastPasswordRotation, nil
+}
+
+func (r *rotationEnsurer) rotationJob(v *appv1beta1.VisitorsApp, scheme *runtime.Scheme) *batchv1.Job {
+	labels := labels(v, "rotation")
+	database := visitorsDatabase(v, r.mysqlServicePostfix, r.mysqlAuthPostfix)
+	backoffLimit := int32(2)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      v.Name + r.jobPostfix,
+			Namespace: v.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Image:   tierImage(v.Spec.Database.MySQL.TierSpec, r.image),
+						Name:    "visitors-password-rotation",
+						Command: []string{"bash", "-c", rotationScript},
+						Env: append(databaseClientEnv(database),
+							corev1.EnvVar{
+								Name: "NEW_PASSWORD",
+								ValueFrom: &corev1.EnvVarSource{
+									SecretKeyRef: &corev1.SecretKeySelector{
+										LocalObjectReference: corev1.LocalObjectReference{Name: v.Name + r.secretPostfix},
+										Key:                  mysqlPasswordKey,
+									},
+								},
+							},
+						),
+					}},
+				},
+			},
+		},
+	}
+
+	controllerutil.SetControllerReference(v, job, scheme)
+	return job
+}
+
+// recordPasswordRotation records the last rotation and when the next one is
+// due on the instance
+func recordPasswordRotation(v *appv1beta1.VisitorsApp, last *metav1.Time) {
+	v.Status.LastPasswordRotation = last
+	v.SetCondition(appv1beta1.ConditionPasswordRotated, metav1.ConditionTrue,
+		"Rotated", "The next rotation is due at "+nextPasswordRotation(v, last).UTC().Format(time.RFC3339))
+}
+
+// rotationEnabled returns whether the instance asks for the operator generated
+// credentials to be rotated
+func rotationEnabled(v *appv1beta1.VisitorsApp) bool {
+	return v.Spec.Database.MySQL.PasswordRotation != nil &&
+		v.Spec.Database.MySQL.CredentialsSecret == "" &&
+		v.Spec.Database.External == nil
+}
+
+// nextPasswordRotation returns when the next rotation is due, one interval
+// after the last rotation or after the creation of the instance
+func nextPasswordRotation(v *appv1beta1.VisitorsApp, last *metav1.Time) time.Time {
+	from := v.CreationTimestamp.Time
+	if last != nil {
+		from = last.Time
+	}
+	return from.Add(v.Spec.Database.MySQL.PasswordRotation.Interval.Duration)
+}
+
+func NewRotationEnsurer(
+	cli client.Client,
+	recorder record.EventRecorder,
+	image string,
+	jobPostfix string,
+	secretPostfix string,
+	mysqlServicePostfix string,
+	mysqlAuthPostfix string,
+) WorkloadEnsurer {
+	return &rotationEnsurer{
+		client:              cli,
+		recorder:            recorder,
+		image:               image,
+		jobPostfix:          jobPostfix,
+		secretPostfix:       secretPostfix,
+		mysqlServicePostfix: mysqlServicePostfix,
+		mysqlAuthPostfix:    mysqlAuthPostfix,
+	}
+}
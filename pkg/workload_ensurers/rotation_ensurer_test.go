@@ -0,0 +1,75 @@
+package workload_ensurers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// A completed rotation is found again on the credentials secret when the
+// status update recording it was lost, rather than starting another one
+func TestPasswordRotationSurvivesLostStatusUpdate(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestApp()
+	instance.Spec.Database.MySQL.PasswordRotation = &appv1beta1.PasswordRotationSpec{
+		Interval: metav1.Duration{Duration: time.Hour},
+	}
+	auth := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-mysql-auth", Namespace: "default"},
+		Data: map[string][]byte{
+			mysqlRootPasswordKey: []byte("root"),
+			mysqlUsernameKey:     []byte("visitors-user"),
+			mysqlPasswordKey:     []byte("old"),
+		},
+	}
+	cli := newTestClient(t, instance, auth)
+	scheme := cli.Scheme()
+	request := newTestRequest(instance)
+
+	director := NewEnsureWorkloadDirector()
+	rotation := NewRotationEnsurer(cli, newTestRecorder(), appv1beta1.DefaultMySQLImage,
+		"-mysql-password-rotation", "-mysql-auth-pending", "-mysql-service", "-mysql-auth")
+	pendingKey := types.NamespacedName{Name: "app-mysql-auth-pending", Namespace: "default"}
+
+	// The rotation is due, run it to completion
+	if _, err := director.EnsureTier(ctx, rotation, "rotation", "", request, instance, scheme); err != nil {
+		t.Fatal(err)
+	}
+	job := &batchv1.Job{}
+	if err := cli.Get(ctx, types.NamespacedName{Name: "app-mysql-password-rotation", Namespace: "default"}, job); err != nil {
+		t.Fatalf("rotation job wasn't created: %v", err)
+	}
+	job.Status.Succeeded = 1
+	if err := cli.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := director.EnsureTier(ctx, rotation, "rotation", "", request, instance, scheme); err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status.LastPasswordRotation == nil {
+		t.Fatal("the rotation wasn't recorded")
+	}
+
+	// Drop what the status update would have written
+	instance.Status = appv1beta1.VisitorsAppStatus{}
+	result, err := director.EnsureTier(ctx, rotation, "rotation", "", request, instance, scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Get(ctx, pendingKey, &corev1.Secret{}); !errors.IsNotFound(err) {
+		t.Errorf("another rotation was started, getting the pending secret: %v", err)
+	}
+	if result == nil || result.RequeueAfter < 59*time.Minute {
+		t.Errorf("EnsureTier() = %+v, want a requeue when the next rotation is due", result)
+	}
+	if instance.Status.LastPasswordRotation == nil {
+		t.Error("the rotation wasn't recorded again")
+	}
+}
@@ -0,0 +1,121 @@
+package workload_ensurers
+
+import (
+	"context"
+	"fmt"
+
+	appv1beta1 "example.com/m/v2/pkg/api/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// TierDefinition declares a tier of the app for NewTierPipeline
+type TierDefinition struct {
+	// Name identifies the tier in the DependsOn of other tiers
+	Name string
+	// DependsOn lists the tiers that must be ready before this one is ensured
+	DependsOn []string
+	// ReadyCondition is the condition the tier keeps up to date, it counts
+	// towards the Ready condition of the app. Empty for auxiliary tiers.
+	ReadyCondition string
+	Ensurer        WorkloadEnsurer
+}
+
+type tier struct {
+	definition TierDefinition
+	director   EnsureWorkloadDirector
+}
+
+func (t *tier) Name() string {
+	return t.definition.Name
+}
+
+func (t *tier) DependsOn() []string {
+	return t.definition.DependsOn
+}
+
+func (t *tier) ReadyCondition() string {
+	return t.definition.ReadyCondition
+}
+
+func (t *tier) Ensure(
+	ctx context.Context,
+	request reconcile.Request,
+	instance *appv1beta1.VisitorsApp,
+	scheme *runtime.Scheme,
+) (*reconcile.Result, error) {
+	return t.director.EnsureTier(ctx, t.definition.Ensurer, t.definition.Name, t.definition.ReadyCondition,
+		request, instance, scheme)
+}
+
+type tierPipeline struct {
+	tiers []Tier
+}
+
+// Tiers returns the tiers ordered so that every tier comes after the ones it
+// depends on
+func (p *tierPipeline) Tiers() []Tier {
+	return p.tiers
+}
+
+// NewTierPipeline orders the given tiers along their dependencies, each is
+// ensured by the director. Tiers that don't depend on each other keep the
+// order they are given in. It fails on duplicate names, unknown dependencies
+// and dependency cycles.
+func NewTierPipeline(director EnsureWorkloadDirector, definitions ...TierDefinition) (TierPipeline, error) {
+	byName := map[string]TierDefinition{}
+	for _, definition := range definitions {
+		if definition.Name == "" {
+			return nil, fmt.Errorf("tier has no name")
+		}
+		if _, found := byName[definition.Name]; found {
+			return nil, fmt.Errorf("tier %q is defined twice", definition.Name)
+		}
+		if definition.Ensurer == nil {
+			return nil, fmt.Errorf("tier %q needs an ensurer", definition.Name)
+		}
+		byName[definition.Name] = definition
+	}
+	for _, definition := range definitions {
+		for _, dependency := range definition.DependsOn {
+			if _, found := byName[dependency]; !found {
+				return nil, fmt.Errorf("tier %q depends on unknown tier %q", definition.Name, dependency)
+			}
+		}
+	}
+
+	// Repeatedly pick the first tier whose dependencies are all placed
+	placed := map[string]bool{}
+	tiers := make([]Tier, 0, len(definitions))
+	for len(tiers) < len(definitions) {
+		progress := false
+		for _, definition := range definitions {
+			if placed[definition.Name] || !allPlaced(definition.DependsOn, placed) {
+				continue
+			}
+			placed[definition.Name] = true
+			tiers = append(tiers, &tier{definition: definition, director: director})
+			progress = true
+			break
+		}
+		if !progress {
+			var remaining []string
+			for _, definition := range definitions {
+				if !placed[definition.Name] {
+					remaining = append(remaining, definition.Name)
+				}
+			}
+			return nil, fmt.Errorf("tiers %v have cyclic dependencies", remaining)
+		}
+	}
+	return &tierPipeline{tiers: tiers}, nil
+}
+
+func allPlaced(names []string, placed map[string]bool) bool {
+	for _, name := range names {
+		if !placed[name] {
+			return false
+		}
+	}
+	return true
+}
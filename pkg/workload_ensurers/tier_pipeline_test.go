@@ -0,0 +1,113 @@
+package workload_ensurers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewTierPipeline(t *testing.T) {
+	// The ensurers are never called, any will do
+	ensurer := NewExternalDatabaseEnsurer(nil, nil)
+	tier := func(name string, dependsOn ...string) TierDefinition {
+		return TierDefinition{Name: name, DependsOn: dependsOn, Ensurer: ensurer}
+	}
+
+	tests := []struct {
+		name        string
+		definitions []TierDefinition
+		want        []string
+		// err is part of the expected error, none when empty
+		err string
+	}{
+		{
+			name:        "no tier",
+			definitions: nil,
+			want:        []string{},
+		},
+		{
+			name: "dependencies first",
+			definitions: []TierDefinition{
+				tier("frontend"),
+				tier("backend", "mysql", "restore"),
+				tier("restore", "mysql"),
+				tier("mysql"),
+			},
+			want: []string{"frontend", "mysql", "restore", "backend"},
+		},
+		{
+			name: "independent tiers keep their order",
+			definitions: []TierDefinition{
+				tier("mysql"),
+				tier("backup", "mysql"),
+				tier("restore", "mysql"),
+				tier("frontend"),
+			},
+			want: []string{"mysql", "backup", "restore", "frontend"},
+		},
+		{
+			name:        "unnamed tier",
+			definitions: []TierDefinition{tier("")},
+			err:         "has no name",
+		},
+		{
+			name:        "duplicate",
+			definitions: []TierDefinition{tier("mysql"), tier("backend", "mysql"), tier("mysql")},
+			err:         `tier "mysql" is defined twice`,
+		},
+		{
+			name:        "missing ensurer",
+			definitions: []TierDefinition{{Name: "mysql"}},
+			err:         `tier "mysql" needs an ensurer`,
+		},
+		{
+			name:        "unknown dependency",
+			definitions: []TierDefinition{tier("mysql"), tier("backend", "mysql", "cache")},
+			err:         `tier "backend" depends on unknown tier "cache"`,
+		},
+		{
+			name:        "self dependency",
+			definitions: []TierDefinition{tier("mysql", "mysql")},
+			err:         "tiers [mysql] have cyclic dependencies",
+		},
+		{
+			name: "cycle",
+			definitions: []TierDefinition{
+				tier("mysql"),
+				tier("backend", "mysql", "frontend"),
+				tier("frontend", "backend"),
+			},
+			err: "tiers [backend frontend] have cyclic dependencies",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := NewTierPipeline(NewEnsureWorkloadDirector(), tt.definitions...)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []string{}
+			placed := map[string]bool{}
+			for _, tier := range pipeline.Tiers() {
+				for _, dependency := range tier.DependsOn() {
+					if !placed[dependency] {
+						t.Errorf("tier %q comes before its dependency %q", tier.Name(), dependency)
+					}
+				}
+				placed[tier.Name()] = true
+				got = append(got, tier.Name())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tiers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}